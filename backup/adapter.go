@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"daemon/config"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	LocalAdapter = "local"
+	S3Adapter    = "s3"
+	DedupAdapter = "dedup"
+)
+
+// Adapter stores backup archives. The metadata of a backup is always kept in
+// the local backup directory, only the archive itself goes through the
+// adapter.
+type Adapter interface {
+	// Write stores the archive read from r until EOF.
+	Write(b *Backup, r io.Reader) error
+	// Open returns a reader that streams the stored archive.
+	Open(b *Backup) (io.ReadCloser, error)
+	Delete(b *Backup) error
+}
+
+func getAdapter(name string) (Adapter, error) {
+	switch name {
+	case "", LocalAdapter:
+		return &localAdapter{}, nil
+	case S3Adapter:
+		c := config.Get().Backup.S3
+		if c.Bucket == "" {
+			return nil, errors.New("s3 backups are not configured on this node")
+		}
+
+		return newS3Adapter(c), nil
+	case DedupAdapter:
+		return &dedupAdapter{}, nil
+	}
+
+	return nil, errors.New("unknown backup adapter: " + name)
+}
+
+type localAdapter struct{}
+
+func (a *localAdapter) Write(b *Backup, r io.Reader) error {
+	f, err := os.Create(b.archivePath())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (a *localAdapter) Open(b *Backup) (io.ReadCloser, error) {
+	return os.Open(b.archivePath())
+}
+
+func (a *localAdapter) Delete(b *Backup) error {
+	if err := os.Remove(b.archivePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
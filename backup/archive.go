@@ -0,0 +1,292 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// counter calls fn with the total amount of bytes passed through it.
+type counter struct {
+	io.Reader
+	n  int64
+	fn func(int64)
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	if c.fn != nil {
+		c.fn(c.n)
+	}
+	return n, err
+}
+
+// walkVolume calls fn for every directory and regular file below root with
+// its slash separated path relative to root. Paths matched by ignore are
+// passed to excluded instead, without descending into directories. Symlinks
+// and other special files are skipped, as restoring them could point outside
+// of the volume.
+func walkVolume(root string, ignore *ignoreMatcher, excluded func(rel string), fn func(rel string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+
+		if ignore.Match(rel, d.IsDir()) {
+			if excluded != nil {
+				excluded(rel)
+			}
+
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(rel, info)
+	})
+}
+
+// volumeSize returns the total size of the files that are archived from root.
+func volumeSize(root string, ignore *ignoreMatcher) (int64, error) {
+	var size int64
+	err := walkVolume(root, ignore, nil, func(_ string, info fs.FileInfo) error {
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// writeArchive writes a tarball of root to w, gzip compressed if compress is
+// set. The paths left out because of ignore are passed to excluded, and
+// progress is called with the amount of file content bytes archived so far.
+func writeArchive(w io.Writer, root string, ignore *ignoreMatcher, excluded func(string), progress func(int64), compress bool) error {
+	var gw *gzip.Writer
+	if compress {
+		gw = gzip.NewWriter(w)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+
+	var written int64
+	err := walkVolume(root, ignore, excluded, func(rel string, info fs.FileInfo) error {
+		n, err := writeEntry(tw, root, rel, info)
+		written += n
+		if progress != nil && !info.IsDir() {
+			progress(written)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if gw != nil {
+		return gw.Close()
+	}
+	return nil
+}
+
+// writeEntry writes the header and content of a file or directory below root
+// to tw, and returns the amount of content bytes written. The content is cut
+// or padded to the size in info, as the header was written with it and the
+// file can change while it is archived.
+func writeEntry(tw *tar.Writer, root string, rel string, info fs.FileInfo) (int64, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return 0, err
+	}
+
+	header.Name = rel
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		return 0, nil
+	}
+
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(tw, io.LimitReader(f, info.Size()))
+	if err != nil {
+		return n, err
+	}
+
+	if n < info.Size() {
+		log.WithField("file", rel).Warnf("file shrank from %d to %d bytes while it was archived, padding it with zeros", info.Size(), n)
+		padded, err := io.Copy(tw, io.LimitReader(zeros{}, info.Size()-n))
+		return n + padded, err
+	}
+
+	return n, nil
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// extractArchive extracts a tarball, gzip compressed if compressed is set,
+// into root. Entries that would end up outside of root, symlinks and other
+// special files are skipped.
+func extractArchive(r io.Reader, root string, compressed bool) error {
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name == "" {
+			continue
+		}
+
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if !insideRoot(root, filepath.Dir(target)) {
+			continue
+		}
+		mode := fs.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+
+			if err := writeFile(target, tr, mode); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		_ = os.Chtimes(target, header.ModTime, header.ModTime)
+	}
+}
+
+// insideRoot reports whether dir is root or a directory below it that can be
+// reached without following a symlink.
+func insideRoot(root string, dir string) bool {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	if rel == "." {
+		return true
+	}
+
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return true
+		}
+
+		if err != nil || info.Mode()&fs.ModeSymlink != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeFile(target string, r io.Reader, mode fs.FileMode) error {
+	// remove whatever is at the target first, so an existing symlink is
+	// replaced instead of followed.
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// truncateVolume removes everything inside root, keeping root itself.
+func truncateVolume(root string) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(root, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteEntryOfShrunkFile(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "world.dat")
+	data := randomData(6, 1000)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server truncates the file after it was walked.
+	if err := os.Truncate(file, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	n, err := writeEntry(tw, root, "world.dat", info)
+	if err != nil {
+		t.Fatalf("writeEntry() failed: %v", err)
+	}
+	if n != 1000 {
+		t.Fatalf("writeEntry() wrote %d bytes, want the 1000 of the header", n)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing the archive failed: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Size != 1000 || len(got) != 1000 {
+		t.Fatalf("the entry is %d bytes with a header of %d, want 1000", len(got), h.Size)
+	}
+	if !bytes.Equal(got[:100], data[:100]) || !bytes.Equal(got[100:], make([]byte, 900)) {
+		t.Fatal("the entry isn't the remaining content padded with zeros")
+	}
+}
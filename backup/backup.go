@@ -0,0 +1,467 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"daemon/config"
+	"daemon/events"
+	"daemon/server"
+	"daemon/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBackupNotFound   = errors.New("backup not found")
+	ErrBackupInProgress = errors.New("a backup operation is already in progress for this server")
+
+	operationsMu sync.Mutex
+	operations   = map[string]struct{}{}
+)
+
+type Backup struct {
+	Uuid         string   `json:"uuid"`
+	Server       string   `json:"server"`
+	Checksum     string   `json:"checksum"`
+	ChecksumType string   `json:"checksum_type"`
+	Size         int64    `json:"size"`
+	Ignored      []string `json:"ignored"`
+	Excluded     []string `json:"excluded"`
+	Adapter      string   `json:"adapter"`
+	Completed    bool     `json:"completed"`
+	CreatedAt    int64    `json:"created_at"`
+	CompletedAt  int64    `json:"completed_at"`
+}
+
+func directory(s *server.Server) string {
+	c := config.Get()
+	return utils.Normalize(c.System.BackupDirectory + "/" + s.Uuid)
+}
+
+func (b *Backup) archivePath() string {
+	c := config.Get()
+	return utils.Normalize(c.System.BackupDirectory + "/" + b.Server + "/" + b.Uuid + ".tar.gz")
+}
+
+func (b *Backup) metadataPath() string {
+	c := config.Get()
+	return utils.Normalize(c.System.BackupDirectory + "/" + b.Server + "/" + b.Uuid + ".json")
+}
+
+func (b *Backup) save() error {
+	data, err := json.MarshalIndent(b, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(b.metadataPath(), data, 0644)
+}
+
+// lock marks a backup or restore as running for the server, failing if one is
+// already running.
+func lock(s *server.Server) error {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+
+	if _, ok := operations[s.Uuid]; ok {
+		return ErrBackupInProgress
+	}
+
+	operations[s.Uuid] = struct{}{}
+	return nil
+}
+
+func unlock(s *server.Server) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+
+	delete(operations, s.Uuid)
+}
+
+// Create starts archiving the server volume in the background and returns
+// the pending backup. Paths matching the gitignore patterns of the
+// .zephyrignore file in the volume root, and of ignored, are left out of the
+// archive and recorded in the metadata of the backup. The archive is stored
+// with the named adapter, or the one configured for the node if empty.
+// Progress and completion are published as events.
+func Create(s *server.Server, ignored []string, adapter string) (*Backup, error) {
+	b, _, err := start(s, ignored, adapter)
+	return b, err
+}
+
+// CreateAndWait creates a backup like Create, but returns once the backup
+// completed, with the error that made it fail.
+func CreateAndWait(s *server.Server, ignored []string, adapter string) (*Backup, error) {
+	b, done, err := start(s, ignored, adapter)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return Get(s, b.Uuid)
+}
+
+// start starts a backup in the background. The returned channel receives the
+// outcome of the backup once it completed.
+func start(s *server.Server, ignored []string, adapter string) (*Backup, <-chan error, error) {
+	if adapter == "" {
+		adapter = config.Get().Backup.Adapter
+	}
+
+	if _, err := getAdapter(adapter); err != nil {
+		return nil, nil, err
+	}
+
+	if err := lock(s); err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.MkdirAll(directory(s), 0755); err != nil {
+		unlock(s)
+		return nil, nil, err
+	}
+
+	lines, err := loadIgnoreFile(s.VolumePath())
+	if err != nil {
+		unlock(s)
+		return nil, nil, err
+	}
+
+	ignored = append(append([]string{}, lines...), ignored...)
+	if _, err := newIgnoreMatcher(ignored); err != nil {
+		unlock(s)
+		return nil, nil, err
+	}
+
+	b := &Backup{
+		Uuid:         uuid.New().String(),
+		Server:       s.Uuid,
+		ChecksumType: "sha256",
+		Ignored:      ignored,
+		Excluded:     []string{},
+		Adapter:      adapter,
+		CreatedAt:    time.Now().Unix(),
+	}
+	if err := b.save(); err != nil {
+		unlock(s)
+		return nil, nil, err
+	}
+
+	pending := *b
+	done := make(chan error, 1)
+	s.Go("backup", func() {
+		// a panic in create is reported by s.Go, the waiter is told too.
+		err := errors.New("backup failed unexpectedly")
+		defer func() {
+			done <- err
+		}()
+		defer unlock(s)
+
+		err = b.create(s)
+		if err != nil {
+			log.WithError(err).WithField("server", s.Uuid).Error("failed to create backup")
+			if a, aerr := getAdapter(b.Adapter); aerr == nil {
+				_ = a.Delete(b)
+			}
+			_ = os.Remove(b.metadataPath())
+		} else {
+			log.WithField("server", s.Uuid).Infof("created backup %s", b.Uuid)
+		}
+
+		publishCompleted(events.ServerBackupCompleted, s, b, err)
+	})
+
+	return &pending, done, nil
+}
+
+func (b *Backup) create(s *server.Server) error {
+	a, err := getAdapter(b.Adapter)
+	if err != nil {
+		return err
+	}
+
+	ignore, err := newIgnoreMatcher(b.Ignored)
+	if err != nil {
+		return err
+	}
+
+	root := s.VolumePath()
+	total, err := volumeSize(root, ignore)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	archived := make(chan error, 1)
+	go func() {
+		progress := newProgress(events.ServerBackupProgress, s, b, total)
+		err := writeArchive(pw, root, ignore, func(rel string) {
+			b.Excluded = append(b.Excluded, rel)
+		}, progress.update, b.Compressed())
+		_ = pw.CloseWithError(err)
+		archived <- err
+	}()
+
+	hash := sha256.New()
+	r := &counter{Reader: io.TeeReader(pr, hash)}
+	if err := a.Write(b, r); err != nil {
+		_ = pr.CloseWithError(err)
+		<-archived
+		return err
+	}
+
+	if err := <-archived; err != nil {
+		return err
+	}
+
+	b.Checksum = hex.EncodeToString(hash.Sum(nil))
+	b.Size = r.n
+	b.Completed = true
+	b.CompletedAt = time.Now().Unix()
+	return b.save()
+}
+
+// List returns the backups of the server, the most recent first.
+func List(s *server.Server) ([]Backup, error) {
+	entries, err := os.ReadDir(directory(s))
+	if os.IsNotExist(err) {
+		return []Backup{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	backups := []Backup{}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(directory(s), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var b Backup
+		if err := json.Unmarshal(data, &b); err != nil {
+			log.WithError(err).WithField("server", s.Uuid).Warnf("failed to read backup %s", e.Name())
+			continue
+		}
+
+		backups = append(backups, b)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt > backups[j].CreatedAt
+	})
+
+	return backups, nil
+}
+
+// Get returns a backup of the server by its UUID.
+func Get(s *server.Server, id string) (*Backup, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrBackupNotFound
+	}
+
+	b := &Backup{Uuid: id, Server: s.Uuid}
+	data, err := os.ReadFile(b.metadataPath())
+	if os.IsNotExist(err) {
+		return nil, ErrBackupNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Compressed reports whether the archive of the backup is a gzip compressed
+// tarball. Deduplicated backups compress their chunks instead, so their
+// archive is a plain tarball.
+func (b *Backup) Compressed() bool {
+	return b.Adapter != DedupAdapter
+}
+
+// Open returns a reader that streams the archive of a completed backup from
+// its adapter.
+func (b *Backup) Open() (io.ReadCloser, error) {
+	if !b.Completed {
+		return nil, errors.New("backup has not been completed yet")
+	}
+
+	a, err := getAdapter(b.Adapter)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Open(b)
+}
+
+// Verify reads the whole archive of a completed backup and checks it against
+// the checksum taken when it was created. ErrBackupCorrupted is returned if
+// it does not match, or if a chunk of a deduplicated backup is missing or
+// damaged.
+func (b *Backup) Verify() error {
+	r, err := b.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != b.Checksum {
+		return fmt.Errorf("%w: checksum does not match", ErrBackupCorrupted)
+	}
+
+	return nil
+}
+
+// Restore starts restoring a backup into the server volume in the background.
+// The archive is verified first, and the volume is left alone when it is
+// corrupted. Then the server is stopped, and when truncate is set, everything
+// in the volume is removed before the archive is extracted.
+func (b *Backup) Restore(s *server.Server, truncate bool) error {
+	if !b.Completed {
+		return errors.New("backup has not been completed yet")
+	}
+
+	if err := lock(s); err != nil {
+		return err
+	}
+
+	s.Go("backup restore", func() {
+		defer unlock(s)
+
+		err := b.restore(s, truncate)
+		if err != nil {
+			log.WithError(err).WithField("server", s.Uuid).Error("failed to restore backup")
+		} else {
+			log.WithField("server", s.Uuid).Infof("restored backup %s", b.Uuid)
+		}
+
+		publishCompleted(events.ServerBackupRestoreCompleted, s, b, err)
+	})
+
+	return nil
+}
+
+func (b *Backup) restore(s *server.Server, truncate bool) error {
+	if err := b.Verify(); err != nil {
+		return err
+	}
+
+	if s.State != server.Stopped {
+		events.ForServer(s.Uuid, events.ServerLog, map[string]interface{}{
+			"daemon":  true,
+			"message": "Stopping server to restore a backup",
+		}).Publish()
+
+		if err := s.Power(server.PowerStop); err != nil {
+			return err
+		}
+	}
+
+	f, err := b.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	root := s.VolumePath()
+	if truncate {
+		if err := truncateVolume(root); err != nil {
+			return err
+		}
+	}
+
+	progress := newProgress(events.ServerBackupRestoreProgress, s, b, b.Size)
+	return extractArchive(&counter{Reader: f, fn: progress.update}, root, b.Compressed())
+}
+
+// Delete removes the stored archive and the metadata of a backup.
+func (b *Backup) Delete() error {
+	if !b.Completed {
+		operationsMu.Lock()
+		_, running := operations[b.Server]
+		operationsMu.Unlock()
+
+		if running {
+			return ErrBackupInProgress
+		}
+	}
+
+	a, err := getAdapter(b.Adapter)
+	if err != nil {
+		return err
+	}
+
+	if err := a.Delete(b); err != nil {
+		return err
+	}
+
+	return os.Remove(b.metadataPath())
+}
+
+type progress struct {
+	event  string
+	server *server.Server
+	backup *Backup
+	total  int64
+	last   time.Time
+}
+
+func newProgress(event string, s *server.Server, b *Backup, total int64) *progress {
+	return &progress{event: event, server: s, backup: b, total: total}
+}
+
+// update publishes the progress, at most twice a second.
+func (p *progress) update(done int64) {
+	if time.Since(p.last) < 500*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+
+	percent := 100.0
+	if p.total > 0 && done < p.total {
+		percent = float64(done) / float64(p.total) * 100
+	}
+
+	events.ForServer(p.server.Uuid, p.event, map[string]interface{}{
+		"server":   p.server.Uuid,
+		"backup":   p.backup.Uuid,
+		"progress": percent,
+	}).Publish()
+}
+
+func publishCompleted(event string, s *server.Server, b *Backup, err error) {
+	payload := map[string]interface{}{
+		"server":     s.Uuid,
+		"backup":     b.Uuid,
+		"successful": err == nil,
+		"checksum":   b.Checksum,
+		"size":       b.Size,
+	}
+	if err != nil {
+		payload["error"] = err.Error()
+	}
+
+	events.ForServer(s.Uuid, event, payload).Publish()
+}
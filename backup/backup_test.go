@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"daemon/config"
+	"daemon/server"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestServer returns a stopped server whose volume and backups are in a
+// temporary directory.
+func newTestServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	dir := t.TempDir()
+	c := config.DefaultConfig(filepath.Join(dir, "config.yml"))
+	c.System.DataDirectory = filepath.Join(dir, "data")
+	c.System.VolumesDirectory = filepath.Join(dir, "volumes")
+	c.System.BackupDirectory = filepath.Join(dir, "backups")
+	config.Set(c)
+
+	s := &server.Server{Id: "00000000", Uuid: "00000000-0000-0000-0000-000000000000", State: server.Stopped}
+	if err := os.MkdirAll(s.VolumePath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(directory(s), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestRestoreOfCorruptedBackupKeepsVolume(t *testing.T) {
+	s := newTestServer(t)
+
+	kept := filepath.Join(s.VolumePath(), "world.dat")
+	if err := os.WriteFile(kept, []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backup{
+		Uuid:      "11111111-1111-1111-1111-111111111111",
+		Server:    s.Uuid,
+		Checksum:  "0000000000000000000000000000000000000000000000000000000000000000",
+		Adapter:   LocalAdapter,
+		Completed: true,
+	}
+	if err := os.WriteFile(b.archivePath(), []byte("partly uploaded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.restore(s, true); !errors.Is(err, ErrBackupCorrupted) {
+		t.Fatalf("restore() = %v, want ErrBackupCorrupted", err)
+	}
+
+	if b, err := os.ReadFile(kept); err != nil || string(b) != "world" {
+		t.Fatalf("the volume was changed by a failed restore: %q, %v", b, err)
+	}
+}
+
+func TestCreateAndWait(t *testing.T) {
+	s := newTestServer(t)
+	if err := os.WriteFile(filepath.Join(s.VolumePath(), "world.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := CreateAndWait(s, nil, LocalAdapter)
+	if err != nil {
+		t.Fatalf("CreateAndWait() failed: %v", err)
+	}
+	if !b.Completed || b.Checksum == "" {
+		t.Fatalf("CreateAndWait() returned a backup that isn't completed: %+v", b)
+	}
+	if err := b.Verify(); err != nil {
+		t.Fatalf("the created backup doesn't verify: %v", err)
+	}
+
+	if err := os.RemoveAll(s.VolumePath()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateAndWait(s, nil, LocalAdapter); err == nil {
+		t.Fatal("CreateAndWait() of a missing volume didn't fail")
+	}
+}
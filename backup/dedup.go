@@ -0,0 +1,425 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"daemon/config"
+	"daemon/utils"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Chunks are cut where the rolling hash of the content matches chunkMask, so
+// a change in a file only affects the chunks around it. With 20 mask bits the
+// average chunk is about 1MB past the minimum size.
+const (
+	minChunkSize = 256 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+	chunkMask    = uint64(1<<20-1) << 44
+)
+
+var (
+	ErrBackupCorrupted = errors.New("backup is corrupted")
+
+	gearTable = newGearTable()
+
+	// storeMu is held for reading while a snapshot is written, and for writing
+	// while unreferenced chunks are collected, so chunks of a snapshot that is
+	// still being written are never removed.
+	storeMu sync.RWMutex
+)
+
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+
+	return table
+}
+
+// snapshotEntry is a tar header of an archived path, with the chunks that make
+// up the content of regular files.
+type snapshotEntry struct {
+	Name     string   `json:"name"`
+	Typeflag byte     `json:"type"`
+	Mode     int64    `json:"mode"`
+	Uid      int      `json:"uid"`
+	Gid      int      `json:"gid"`
+	Uname    string   `json:"uname"`
+	Gname    string   `json:"gname"`
+	ModTime  int64    `json:"mod_time"`
+	Size     int64    `json:"size"`
+	Chunks   []string `json:"chunks,omitempty"`
+}
+
+type snapshot struct {
+	Entries []snapshotEntry `json:"entries"`
+}
+
+// dedupAdapter stores archives as snapshots of content addressed, compressed
+// chunks that are shared between all backups of the node. It takes and
+// returns plain tarballs, as the chunks are compressed on their own.
+type dedupAdapter struct{}
+
+func chunksDirectory() string {
+	return utils.Normalize(config.Get().System.BackupDirectory + "/.chunks")
+}
+
+func chunkPath(id string) string {
+	return filepath.Join(chunksDirectory(), id[:2], id)
+}
+
+func (b *Backup) snapshotPath() string {
+	c := config.Get()
+	return utils.Normalize(c.System.BackupDirectory + "/" + b.Server + "/" + b.Uuid + ".snapshot")
+}
+
+func (a *dedupAdapter) Write(b *Backup, r io.Reader) error {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
+	snap := snapshot{Entries: []snapshotEntry{}}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		e := snapshotEntry{
+			Name:     header.Name,
+			Typeflag: header.Typeflag,
+			Mode:     header.Mode,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			Uname:    header.Uname,
+			Gname:    header.Gname,
+			ModTime:  header.ModTime.Unix(),
+			Size:     header.Size,
+		}
+		if header.Typeflag == tar.TypeReg {
+			if e.Chunks, err = writeChunks(tr); err != nil {
+				return err
+			}
+		}
+
+		snap.Entries = append(snap.Entries, e)
+	}
+
+	// read the end of the archive as well, as the writer waits for it to be
+	// consumed.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(b.snapshotPath(), data)
+}
+
+func (a *dedupAdapter) Open(b *Backup) (io.ReadCloser, error) {
+	data, err := os.ReadFile(b.snapshotPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBackupCorrupted, err.Error())
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(writeSnapshot(pw, &snap))
+	}()
+
+	return pr, nil
+}
+
+// Delete removes the snapshot and then collects the chunks no other snapshot
+// uses in the background.
+func (a *dedupAdapter) Delete(b *Backup) error {
+	if err := os.Remove(b.snapshotPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	go func() {
+		if _, _, err := CollectGarbage(); err != nil {
+			log.WithError(err).Error("failed to collect unreferenced backup chunks")
+		}
+	}()
+
+	return nil
+}
+
+// writeSnapshot rebuilds the tarball a snapshot was created from.
+func writeSnapshot(w io.Writer, snap *snapshot) error {
+	tw := tar.NewWriter(w)
+	for _, e := range snap.Entries {
+		header := &tar.Header{
+			Name:     e.Name,
+			Typeflag: e.Typeflag,
+			Mode:     e.Mode,
+			Uid:      e.Uid,
+			Gid:      e.Gid,
+			Uname:    e.Uname,
+			Gname:    e.Gname,
+			ModTime:  time.Unix(e.ModTime, 0),
+			Size:     e.Size,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		for _, id := range e.Chunks {
+			if err := readChunk(tw, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// writeChunks splits r into content defined chunks and stores the ones that
+// are not in the store yet, returning the IDs of all of them in order.
+func writeChunks(r io.Reader) ([]string, error) {
+	ids := []string{}
+	buf := make([]byte, maxChunkSize)
+	n := 0
+	eof := false
+	for {
+		if !eof {
+			read, err := io.ReadFull(r, buf[n:])
+			n += read
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if n == 0 {
+			return ids, nil
+		}
+
+		cut := cutPoint(buf[:n])
+		id, err := storeChunk(buf[:cut])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+
+		n = copy(buf, buf[cut:n])
+	}
+}
+
+// cutPoint returns the length of the next chunk at the start of data.
+func cutPoint(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+
+	var hash uint64
+	for i := minChunkSize; i < len(data); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(data)
+}
+
+func storeChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+
+	p := chunkPath(id)
+	if _, err := os.Stat(p); err == nil {
+		return id, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), id+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	gw := gzip.NewWriter(f)
+	_, err = gw.Write(data)
+	if err == nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return id, nil
+}
+
+// readChunk writes the content of a chunk to w, checking it against its ID.
+func readChunk(w io.Writer, id string) error {
+	if len(id) != sha256.Size*2 {
+		return fmt.Errorf("%w: invalid chunk %s", ErrBackupCorrupted, id)
+	}
+
+	f, err := os.Open(chunkPath(id))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: missing chunk %s", ErrBackupCorrupted, id)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %s: %s", ErrBackupCorrupted, id, err.Error())
+	}
+
+	data, err := io.ReadAll(io.LimitReader(gr, maxChunkSize+1))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %s: %s", ErrBackupCorrupted, id, err.Error())
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != id {
+		return fmt.Errorf("%w: chunk %s does not match its content", ErrBackupCorrupted, id)
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// CollectGarbage removes the chunks that are not used by any snapshot of the
+// node, returning the amount of chunks removed and the bytes freed.
+func CollectGarbage() (int, int64, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	used := map[string]struct{}{}
+	snapshots, err := filepath.Glob(filepath.Join(utils.Normalize(config.Get().System.BackupDirectory), "*", "*.snapshot"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, p := range snapshots {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var snap snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			// keep everything rather than risk removing chunks of a snapshot
+			// that could still be repaired.
+			return 0, 0, fmt.Errorf("failed to read snapshot %s: %w", p, err)
+		}
+
+		for _, e := range snap.Entries {
+			for _, id := range e.Chunks {
+				used[id] = struct{}{}
+			}
+		}
+	}
+
+	removed := 0
+	var freed int64
+	err = filepath.WalkDir(chunksDirectory(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		// temporary files are never used, they are left over from interrupted
+		// writes as none can be running while the lock is held.
+		if _, ok := used[d.Name()]; ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, err
+	}
+
+	if removed > 0 {
+		log.WithField("freed", freed).Infof("removed %d unreferenced backup chunks", removed)
+	}
+
+	return removed, freed, nil
+}
+
+func writeFileAtomic(target string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), target)
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,239 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// randomData returns the same pseudo random bytes for the same seed.
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunks splits data the way writeChunks does, without storing the chunks.
+func chunks(data []byte) [][]byte {
+	var out [][]byte
+	for len(data) > 0 {
+		window := data
+		if len(window) > maxChunkSize {
+			window = window[:maxChunkSize]
+		}
+
+		cut := cutPoint(window)
+		out = append(out, data[:cut])
+		data = data[cut:]
+	}
+
+	return out
+}
+
+func TestCutPoint(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// min and max bound the cut point.
+		min int
+		max int
+	}{
+		{name: "empty", data: nil, min: 0, max: 0},
+		{name: "shorter than a chunk", data: randomData(1, 1000), min: 1000, max: 1000},
+		{name: "minimum chunk", data: randomData(1, minChunkSize), min: minChunkSize, max: minChunkSize},
+		{name: "random", data: randomData(2, maxChunkSize), min: minChunkSize + 1, max: maxChunkSize},
+		// the hash of a run of zeros settles on a value that doesn't match the
+		// mask, so it is cut at the end of the data.
+		{name: "no match", data: make([]byte, maxChunkSize), min: maxChunkSize, max: maxChunkSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cut := cutPoint(tt.data)
+			if cut < tt.min || cut > tt.max {
+				t.Fatalf("cutPoint() = %d, want between %d and %d", cut, tt.min, tt.max)
+			}
+			if again := cutPoint(tt.data); again != cut {
+				t.Fatalf("cutPoint() isn't deterministic: %d and %d", cut, again)
+			}
+		})
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	data := randomData(3, 24*1024*1024)
+
+	parts := chunks(data)
+	if len(parts) < 8 {
+		t.Fatalf("24MB of random data made %d chunks, want about one per MB", len(parts))
+	}
+	for i, c := range parts {
+		if len(c) > maxChunkSize {
+			t.Fatalf("chunk %d is %d bytes, larger than the maximum", i, len(c))
+		}
+		if i < len(parts)-1 && len(c) <= minChunkSize {
+			t.Fatalf("chunk %d is %d bytes, not larger than the minimum", i, len(c))
+		}
+	}
+}
+
+// TestChunksAfterInsert checks that an insert only changes the chunks around
+// it, which is what lets backups of changed files share chunks.
+func TestChunksAfterInsert(t *testing.T) {
+	data := randomData(4, 16*1024*1024)
+	changed := append(append(append([]byte{}, data[:5*1024*1024]...), []byte("inserted")...), data[5*1024*1024:]...)
+
+	before := map[[32]byte]bool{}
+	for _, c := range chunks(data) {
+		before[sha256.Sum256(c)] = true
+	}
+
+	after := chunks(changed)
+	shared := 0
+	for _, c := range after {
+		if before[sha256.Sum256(c)] {
+			shared++
+		}
+	}
+
+	if shared < len(after)-2 {
+		t.Fatalf("only %d of %d chunks are shared after an insert", shared, len(after))
+	}
+}
+
+func testTarball(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/world.dat", "dir/empty", "server.properties"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func countChunks(t *testing.T) int {
+	t.Helper()
+
+	n := 0
+	err := filepath.WalkDir(chunksDirectory(), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestDedupAdapter(t *testing.T) {
+	s := newTestServer(t)
+	a := &dedupAdapter{}
+
+	files := map[string][]byte{
+		"dir/world.dat":     randomData(5, 3*1024*1024),
+		"dir/empty":         {},
+		"server.properties": []byte("server-port=25565\n"),
+	}
+	first := &Backup{Uuid: "11111111-1111-1111-1111-111111111111", Server: s.Uuid}
+	if err := a.Write(first, bytes.NewReader(testTarball(t, files))); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	stored := countChunks(t)
+
+	// a backup of the same files with a small change only adds the chunks
+	// that changed.
+	files["server.properties"] = []byte("server-port=25566\n")
+	second := &Backup{Uuid: "22222222-2222-2222-2222-222222222222", Server: s.Uuid}
+	if err := a.Write(second, bytes.NewReader(testTarball(t, files))); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if added := countChunks(t) - stored; added != 1 {
+		t.Fatalf("the second backup stored %d new chunks, want 1", added)
+	}
+
+	r, err := a.Open(second)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	got := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("reading the snapshot failed: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if got[h.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = r.Close()
+	for name, data := range files {
+		if !bytes.Equal(got[name], data) {
+			t.Fatalf("%s has %d bytes that don't match the %d archived", name, len(got[name]), len(data))
+		}
+	}
+
+	if err := os.Remove(second.snapshotPath()); err != nil {
+		t.Fatal(err)
+	}
+	removed, _, err := CollectGarbage()
+	if err != nil || removed != 1 {
+		t.Fatalf("CollectGarbage() = %d, %v, want the chunk only the second backup used removed", removed, err)
+	}
+	if countChunks(t) != stored {
+		t.Fatalf("the chunks of the first backup weren't kept")
+	}
+}
+
+func TestDedupAdapterMissingChunk(t *testing.T) {
+	s := newTestServer(t)
+	a := &dedupAdapter{}
+
+	b := &Backup{Uuid: "11111111-1111-1111-1111-111111111111", Server: s.Uuid}
+	if err := a.Write(b, bytes.NewReader(testTarball(t, map[string][]byte{"server.properties": []byte("motd=x\n")}))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(chunksDirectory()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := a.Open(b)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrBackupCorrupted) {
+		t.Fatalf("reading a snapshot with a missing chunk returned %v, want ErrBackupCorrupted", err)
+	}
+}
@@ -0,0 +1,5 @@
+package backup
+
+import "daemon/logging"
+
+var log = logging.For("backup")
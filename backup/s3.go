@@ -0,0 +1,353 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"daemon/config"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Adapter stores archives in an S3 compatible bucket, uploading them in
+// parts so the archive never has to be staged on disk.
+type s3Adapter struct {
+	config config.S3Config
+	client *http.Client
+}
+
+func newS3Adapter(c config.S3Config) *s3Adapter {
+	return &s3Adapter{
+		config: c,
+		client: &http.Client{},
+	}
+}
+
+// timeout returns how long a request may make no progress.
+func (a *s3Adapter) timeout() time.Duration {
+	if a.config.Timeout <= 0 {
+		return 60 * time.Second
+	}
+
+	return time.Duration(a.config.Timeout) * time.Second
+}
+
+func (a *s3Adapter) key(b *Backup) string {
+	prefix := strings.Trim(a.config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return prefix + b.Server + "/" + b.Uuid + ".tar.gz"
+}
+
+func (a *s3Adapter) Write(b *Backup, r io.Reader) error {
+	key := a.key(b)
+
+	res, err := a.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := decodeXML(res, &initiated); err != nil {
+		return err
+	}
+
+	if err := a.uploadParts(key, initiated.UploadId, r); err != nil {
+		abort, aerr := a.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadId}}, nil)
+		if aerr == nil {
+			_ = abort.Body.Close()
+		}
+		return err
+	}
+
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (a *s3Adapter) uploadParts(key string, uploadId string, r io.Reader) error {
+	size := a.config.PartSize
+	if size < 5*1024*1024 {
+		// S3 rejects parts smaller than 5MB, except for the last one.
+		size = 5 * 1024 * 1024
+	}
+
+	var parts []completedPart
+	buf := make([]byte, size)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) && number > 1 {
+			break
+		}
+
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		res, perr := a.do(http.MethodPut, key, url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadId},
+		}, buf[:n])
+		if perr != nil {
+			return perr
+		}
+		_ = res.Body.Close()
+
+		parts = append(parts, completedPart{PartNumber: number, ETag: res.Header.Get("ETag")})
+		if err != nil {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	res, err := a.do(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, body)
+	if err != nil {
+		return err
+	}
+
+	// completing an upload can fail after the response status was sent, in
+	// which case the error is only part of the body.
+	var result struct {
+		XMLName xml.Name
+		Message string `xml:"Message"`
+	}
+	if err := decodeXML(res, &result); err != nil {
+		return err
+	}
+
+	if result.XMLName.Local == "Error" {
+		return errors.New("s3: " + result.Message)
+	}
+
+	return nil
+}
+
+func (a *s3Adapter) Open(b *Backup) (io.ReadCloser, error) {
+	res, err := a.do(http.MethodGet, a.key(b), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (a *s3Adapter) Delete(b *Backup) error {
+	res, err := a.do(http.MethodDelete, a.key(b), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// do sends a signed request for an object of the bucket and returns the
+// response if it was successful.
+func (a *s3Adapter) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(a.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *endpoint
+	if a.config.ForcePathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + a.config.Bucket + "/" + key
+	} else {
+		u.Host = a.config.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	// the request is cancelled when it makes no progress for the timeout,
+	// instead of limiting its total time, as restores stream whole archives
+	// from the response.
+	ctx, cancel := context.WithCancel(context.Background())
+	idle := &idleTimer{timeout: a.timeout(), timer: time.AfterFunc(a.timeout(), cancel), cancel: cancel}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), &idleReader{Reader: bytes.NewReader(body), idle: idle})
+	if err != nil {
+		idle.stop()
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	a.sign(req, u, body)
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		idle.stop()
+		return nil, err
+	}
+	res.Body = &idleReader{Reader: res.Body, closer: res.Body, idle: idle}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+		if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("s3: %s: %s", e.Code, e.Message)
+		}
+
+		return nil, fmt.Errorf("s3: unexpected status %d", res.StatusCode)
+	}
+
+	return res, nil
+}
+
+// sign adds an AWS signature version 4 to the request.
+func (a *s3Adapter) sign(req *http.Request, u url.URL, body []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + u.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(u.Path, false),
+		u.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + a.config.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+a.config.SecretAccessKey), date)
+	key = hmacSHA256(key, a.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+a.config.AccessKeyId+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// idleTimer cancels a request once it made no progress for the timeout.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func (t *idleTimer) stop() {
+	t.timer.Stop()
+	t.cancel()
+}
+
+// idleReader restarts the idle timer of a request whenever its body or the
+// body of its response is read. Closing the response body releases the
+// request.
+type idleReader struct {
+	io.Reader
+	closer io.Closer
+	idle   *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.idle.timer.Reset(r.idle.timeout)
+	return r.Reader.Read(p)
+}
+
+func (r *idleReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+
+	defer r.idle.stop()
+	return r.closer.Close()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by key as required for signing.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and slashes
+// unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func decodeXML(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	return xml.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,372 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"daemon/config"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "minio"
+	testSecretKey = "minio-secret"
+)
+
+// fakeS3 is a stand-in for a MinIO style S3 server, which checks the
+// signature of every request and keeps the objects in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	aborted []string
+	// stall makes object reads stop sending after the first bytes.
+	stall bool
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := verifySignature(r, body); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>%s</Message></Error>", err)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := r.URL.Path
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", `"part-`+strconv.Itoa(n)+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			fmt.Fprint(w, "<Error><Code>NoSuchUpload</Code><Message>upload not found</Message></Error>")
+			return
+		}
+
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var object []byte
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != `"part-`+strconv.Itoa(p.PartNumber)+`"` {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>invalid part</Message></Error>")
+				return
+			}
+			object = append(object, parts[p.PartNumber]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, q.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult><Key>"+key+"</Key></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		f.aborted = append(f.aborted, q.Get("uploadId"))
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>key not found</Message></Error>")
+			return
+		}
+		if f.stall {
+			w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+			_, _ = w.Write(object[:10])
+			w.(http.Flusher).Flush()
+			f.mu.Unlock()
+			<-r.Context().Done()
+			f.mu.Lock()
+			return
+		}
+		_, _ = w.Write(object)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verifySignature checks the AWS signature version 4 of a request as the
+// server received it.
+func verifySignature(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return errors.New("missing signature")
+	}
+
+	fields := map[string]string{}
+	for _, f := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		k, v, _ := strings.Cut(f, "=")
+		fields[k] = v
+	}
+
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != testAccessKey {
+		return errors.New("unknown access key")
+	}
+	scope := credential[1]
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 {
+		return errors.New("invalid scope")
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if sum := sha256Hex(body); payloadHash != sum {
+		return errors.New("payload hash does not match the body")
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	signed, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || time.Since(signed) > 15*time.Minute {
+		return errors.New("invalid date")
+	}
+
+	var headers strings.Builder
+	for _, h := range strings.Split(fields["SignedHeaders"], ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, queryEscape(k)+"="+queryEscape(v))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+testSecretKey), scopeParts[0])
+	for _, p := range scopeParts[1:] {
+		key = hmacSHA256(key, p)
+	}
+	if hex.EncodeToString(hmacSHA256(key, stringToSign)) != fields["Signature"] {
+		return errors.New("signature does not match")
+	}
+
+	return nil
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func newTestS3Adapter(srv *httptest.Server) *s3Adapter {
+	return newS3Adapter(config.S3Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "backups",
+		Prefix:          "node one",
+		AccessKeyId:     testAccessKey,
+		SecretAccessKey: testSecretKey,
+		ForcePathStyle:  true,
+		PartSize:        5 * 1024 * 1024,
+		Timeout:         1,
+	})
+}
+
+func testBackup() *Backup {
+	return &Backup{Uuid: "11111111-1111-1111-1111-111111111111", Server: "00000000-0000-0000-0000-000000000000"}
+}
+
+func TestS3WriteAndOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "single part", size: 1024},
+		{name: "exactly one part", size: 5 * 1024 * 1024},
+		{name: "multiple parts", size: 11*1024*1024 + 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, srv := newFakeS3(t)
+			a := newTestS3Adapter(srv)
+			b := testBackup()
+
+			data := make([]byte, tt.size)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := a.Write(b, bytes.NewReader(data)); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			if _, ok := f.objects["/backups/node one/"+b.Server+"/"+b.Uuid+".tar.gz"]; !ok {
+				t.Fatalf("the object wasn't stored under the expected key, got %d objects", len(f.objects))
+			}
+
+			r, err := a.Open(b)
+			if err != nil {
+				t.Fatalf("Open() failed: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			_ = r.Close()
+			if err != nil {
+				t.Fatalf("reading the object failed: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes that don't match the %d written", len(got), len(data))
+			}
+
+			if err := a.Delete(b); err != nil {
+				t.Fatalf("Delete() failed: %v", err)
+			}
+			if len(f.objects) != 0 {
+				t.Fatal("the object wasn't deleted")
+			}
+		})
+	}
+}
+
+type failingReader struct {
+	r io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("archive failed")
+	}
+
+	return n, err
+}
+
+func TestS3WriteAbortsFailedUpload(t *testing.T) {
+	f, srv := newFakeS3(t)
+	a := newTestS3Adapter(srv)
+
+	data := make([]byte, 6*1024*1024)
+	err := a.Write(testBackup(), &failingReader{r: bytes.NewReader(data)})
+	if err == nil || !strings.Contains(err.Error(), "archive failed") {
+		t.Fatalf("Write() = %v, want the error of the reader", err)
+	}
+
+	if len(f.aborted) != 1 || len(f.uploads) != 0 || len(f.objects) != 0 {
+		t.Fatalf("the upload wasn't aborted: aborted %v, %d uploads, %d objects", f.aborted, len(f.uploads), len(f.objects))
+	}
+}
+
+func TestS3RejectedSignature(t *testing.T) {
+	_, srv := newFakeS3(t)
+	a := newTestS3Adapter(srv)
+	a.config.SecretAccessKey = "wrong"
+
+	err := a.Write(testBackup(), bytes.NewReader([]byte("archive")))
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("Write() = %v, want SignatureDoesNotMatch", err)
+	}
+}
+
+func TestS3OpenMissingObject(t *testing.T) {
+	_, srv := newFakeS3(t)
+	a := newTestS3Adapter(srv)
+
+	if _, err := a.Open(testBackup()); err == nil || !strings.Contains(err.Error(), "NoSuchKey") {
+		t.Fatalf("Open() = %v, want NoSuchKey", err)
+	}
+}
+
+func TestS3StalledRestoreTimesOut(t *testing.T) {
+	f, srv := newFakeS3(t)
+	a := newTestS3Adapter(srv)
+	b := testBackup()
+
+	if err := a.Write(b, bytes.NewReader(make([]byte, 1024))); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.stall = true
+	f.mu.Unlock()
+
+	r, err := a.Open(b)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(r)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("reading a stalled object didn't fail")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("reading a stalled object didn't time out")
+	}
+}
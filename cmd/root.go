@@ -4,8 +4,11 @@ import (
 	"context"
 	"daemon/config"
 	"daemon/env"
+	"daemon/logging"
 	"daemon/router"
+	"daemon/schedule"
 	"daemon/server"
+	"daemon/templates"
 	"daemon/testing"
 	"daemon/utils"
 	"github.com/apex/log"
@@ -23,37 +26,54 @@ var rootCmd = &cobra.Command{
 			return
 		}
 
-		var path = config.DefaultPath
-		if cmd.Flags().Changed("config") {
-			path, _ = cmd.Flags().GetString("config")
+		loadConfig(cmd)
+
+		if err := env.ConfigureDocker(context.Background()); err != nil {
+			log.WithError(err).Fatal("failed to configure docker environment")
 		}
+	},
+	Run: mainRunCmd,
+}
 
-		c, err := config.Load(path)
-		if err != nil {
-			log.WithField("path.go", path).Info("config not found or invalid, creating default")
-			conf, err := config.Set(config.DefaultConfig(path))
-			if err != nil {
-				log.WithError(err).Fatal("failed to set default config")
-			}
+// loadConfig loads the config file given by the flags, creating the default
+// one when it is missing, and sets up the daemon logs with it.
+func loadConfig(cmd *cobra.Command) *config.Config {
+	var path = config.DefaultPath
+	if cmd.Flags().Changed("config") {
+		path, _ = cmd.Flags().GetString("config")
+	}
 
-			if err := conf.Save(); err != nil {
-				log.WithError(err).Fatal("failed to save default config")
-			}
+	c, err := config.Load(path)
+	if err != nil {
+		log.WithField("path.go", path).Info("config not found or invalid, creating default")
+		conf, err := config.Set(config.DefaultConfig(path))
+		if err != nil {
+			log.WithError(err).Fatal("failed to set default config")
+		}
 
-			c = conf
+		if err := conf.Save(); err != nil {
+			log.WithError(err).Fatal("failed to save default config")
 		}
 
-		if debug, _ := cmd.Flags().GetBool("debug"); debug {
-			c.Debug = true
+		c = conf
+	}
+
+	if debug, _ := cmd.Flags().GetBool("debug"); debug {
+		c.Debug = true
+	}
+
+	if err := logging.Configure(c); err != nil {
+		log.WithError(err).Error("failed to configure logging, logging to the console only")
+		if c.Debug {
 			log.SetLevel(log.DebugLevel)
-			log.Debug("running in debug mode")
 		}
+	}
 
-		if err = env.ConfigureDocker(context.Background()); err != nil {
-			log.WithError(err).Fatal("failed to configure docker environment")
-		}
-	},
-	Run: mainRunCmd,
+	if c.Debug {
+		log.Debug("running in debug mode")
+	}
+
+	return c
 }
 
 func Execute() error {
@@ -76,7 +96,7 @@ func mainRunCmd(cmd *cobra.Command, args []string) {
 	log.Info("running main command")
 
 	c := config.Get()
-	log.WithField("config", c).Info("loaded config")
+	log.WithField("config", c.Redacted()).Info("loaded config")
 
 	if t, _ := cmd.Flags().GetBool("test"); t {
 		log.Info("running in testing mode")
@@ -107,7 +127,13 @@ func mainRunCmd(cmd *cobra.Command, args []string) {
 }
 
 func load(c *config.Config) {
-	server.Load(c)
+	if err := templates.Load(); err != nil {
+		log.WithError(err).Fatal("failed to load templates")
+	}
+	if err := server.Load(c); err != nil {
+		log.WithError(err).Fatal("failed to load servers")
+	}
+	schedule.Load()
 }
 
 func initFiles(c *config.Config) {
@@ -136,6 +162,11 @@ func initFiles(c *config.Config) {
 			log.WithError(err).Fatal("failed to create templates path.go")
 		}
 
-		// todo: download default templates
+		if c.Templates.Repository != "" {
+			log.Infof("downloading default templates from %s", c.Templates.Repository)
+			if _, err := templates.Sync(c.Templates.Repository); err != nil {
+				log.WithError(err).Error("failed to download default templates")
+			}
+		}
 	}
 }
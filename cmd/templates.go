@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"daemon/templates"
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+var templatesCmd = &cobra.Command{
+	Use:   "templates",
+	Short: "Manage the server templates",
+}
+
+var templatesSyncCmd = &cobra.Command{
+	Use:   "sync [source]",
+	Short: "Sync the templates from a template repository",
+	Long: "Adds and updates the templates from the index.json of a template repository, given as a URL or a local " +
+		"directory. The repository of the config is used when no source is given.",
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		loadConfig(cmd)
+
+		source := ""
+		if len(args) > 0 {
+			source = args[0]
+		}
+
+		result, err := templates.Sync(source)
+		if err != nil {
+			log.WithError(err).Fatal("failed to sync templates")
+		}
+
+		log.Infof("added %d, updated %d, unchanged %d and skipped %d templates",
+			len(result.Added), len(result.Updated), len(result.Unchanged), len(result.Skipped))
+		if len(result.Skipped) > 0 {
+			log.Infof("skipped templates changed locally: %s", strings.Join(result.Skipped, ", "))
+		}
+		for name, reason := range result.Failed {
+			log.WithField("template", name).Errorf("failed to sync template: %s", reason)
+		}
+	},
+}
+
+func init() {
+	templatesCmd.AddCommand(templatesSyncCmd)
+	rootCmd.AddCommand(templatesCmd)
+}
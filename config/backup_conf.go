@@ -0,0 +1,27 @@
+package config
+
+type BackupConfig struct {
+	// Adapter is the storage used for new backups, either "local", "s3" or
+	// "dedup" for incremental backups deduplicated into chunks below the
+	// backup directory.
+	Adapter string   `default:"local" yaml:"adapter"`
+	S3      S3Config `yaml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint        string `default:"https://s3.amazonaws.com" yaml:"endpoint"`
+	Region          string `default:"us-east-1" yaml:"region"`
+	Bucket          string `default:"" yaml:"bucket"`
+	Prefix          string `default:"" yaml:"prefix"`
+	AccessKeyId     string `default:"" yaml:"access_key_id"`
+	SecretAccessKey string `default:"" yaml:"secret_access_key"`
+
+	// ForcePathStyle puts the bucket in the path instead of the host name,
+	// which most self-hosted S3 compatible servers require.
+	ForcePathStyle bool  `default:"true" yaml:"force_path_style"`
+	PartSize       int64 `default:"16777216" yaml:"part_size"` // 16MB
+
+	// Timeout is how long a request may make no progress, while connecting,
+	// sending, waiting for the response or reading it, before it fails.
+	Timeout int `default:"60" yaml:"timeout"` // seconds
+}
@@ -20,9 +20,16 @@ type Config struct {
 	Token  string `yaml:"token"`
 	Remote string `yaml:"remote"`
 
-	Server ServerConfig `yaml:"server"`
-	System SystemConfig `yaml:"system"`
-	Docker DockerConfig `yaml:"docker"`
+	Server  ServerConfig  `yaml:"server"`
+	System  SystemConfig  `yaml:"system"`
+	Docker  DockerConfig  `yaml:"docker"`
+	Files   FilesConfig   `yaml:"files"`
+	Backup  BackupConfig  `yaml:"backup"`
+	Console ConsoleConfig `yaml:"console"`
+	Logging LoggingConfig `yaml:"logging"`
+
+	Templates TemplatesConfig `yaml:"templates"`
+	Install   InstallConfig   `yaml:"install"`
 }
 
 type ServerConfig struct {
@@ -57,6 +64,7 @@ func Load(path string) (*Config, error) {
 	}
 
 	var config Config
+	defaults.SetDefaults(&config)
 	config.path = path
 	if err := yaml.Unmarshal(b, &config); err != nil {
 		return nil, err
@@ -74,6 +82,29 @@ func Get() *Config {
 	return _config
 }
 
+// Redacted returns a copy of the config with its secrets masked, for logging.
+func (c *Config) Redacted() Config {
+	r := *c
+	r.Token = mask(r.Token)
+	r.Backup.S3.SecretAccessKey = mask(r.Backup.S3.SecretAccessKey)
+
+	r.Docker.Registries = make(map[string]RegistryConfig, len(c.Docker.Registries))
+	for name, registry := range c.Docker.Registries {
+		registry.Password = mask(registry.Password)
+		r.Docker.Registries[name] = registry
+	}
+
+	return r
+}
+
+func mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return "********"
+}
+
 func (c *Config) Save() error {
 	ccopy := *c
 	if ccopy.path == "" {
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	c := DefaultConfig("config.yml")
+	c.Backup.S3.SecretAccessKey = "s3-secret"
+	c.Docker.Registries = map[string]RegistryConfig{
+		"ghcr.io": {Username: "zephyr", Password: "registry-secret"},
+	}
+	token := c.Token
+
+	r := c.Redacted()
+	logged := fmt.Sprintf("%+v", r)
+	for _, secret := range []string{token, "s3-secret", "registry-secret"} {
+		if strings.Contains(logged, secret) {
+			t.Fatalf("the redacted config contains the secret %q", secret)
+		}
+	}
+	if r.Docker.Registries["ghcr.io"].Username != "zephyr" {
+		t.Fatal("the registry user name was redacted")
+	}
+
+	if c.Token != token || c.Backup.S3.SecretAccessKey != "s3-secret" || c.Docker.Registries["ghcr.io"].Password != "registry-secret" {
+		t.Fatal("redacting changed the config itself")
+	}
+}
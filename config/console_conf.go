@@ -0,0 +1,29 @@
+package config
+
+// ConsoleConfig configures the console pipeline of the servers and the
+// console log files kept for every server below the log directory.
+type ConsoleConfig struct {
+	Scrollback int `default:"1000" yaml:"scrollback"` // lines kept in memory
+
+	Persist   bool  `default:"true" yaml:"persist"`
+	MaxSize   int64 `default:"10485760" yaml:"max_size"` // 10MB
+	MaxAge    int   `default:"24" yaml:"max_age"`        // hours
+	Compress  bool  `default:"true" yaml:"compress"`
+	MaxFiles  int   `default:"30" yaml:"max_files"`
+	Retention int   `default:"336" yaml:"retention"` // hours
+
+	Throttle ThrottleConfig `yaml:"throttle"`
+}
+
+// ThrottleConfig limits the console output of a server. Output over the
+// limits is dropped for the rest of the second and summarized afterwards.
+type ThrottleConfig struct {
+	Enabled bool  `default:"true" yaml:"enabled"`
+	Lines   int   `default:"2000" yaml:"lines"`    // per second
+	Bytes   int64 `default:"1048576" yaml:"bytes"` // per second, 1MB
+
+	// StopAfter stops the server once the limits were exceeded in this many
+	// seconds without a cooldown in between. Zero never stops it.
+	StopAfter int `default:"0" yaml:"stop_after"`
+	Cooldown  int `default:"30" yaml:"cooldown"` // seconds
+}
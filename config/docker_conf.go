@@ -32,6 +32,12 @@ type DockerConfig struct {
 	DomainName string `default:"" yaml:"domain_name"`
 
 	Registries map[string]RegistryConfig `yaml:"registries"`
+	// PullPolicy is when images are pulled: always, if-not-present or never.
+	PullPolicy string `default:"if-not-present" yaml:"pull_policy"`
+
+	// StopTimeout is how many seconds a container gets to stop before it is
+	// killed.
+	StopTimeout int `default:"30" yaml:"stop_timeout"`
 
 	TmpfsSize  uint   `default:"100" yaml:"tmpfs_size"` // 100MB
 	UsernsMode string `default:"" yaml:"userns_mode"`
@@ -0,0 +1,36 @@
+package config
+
+type FilesConfig struct {
+	Pull   PullConfig   `yaml:"pull"`
+	Search SearchConfig `yaml:"search"`
+	Trash  TrashConfig  `yaml:"trash"`
+	Watch  WatchConfig  `yaml:"watch"`
+}
+
+type PullConfig struct {
+	Enabled      bool  `default:"true" yaml:"enabled"`
+	MaxSize      int64 `default:"1073741824" yaml:"max_size"` // 1GB
+	MaxRedirects int   `default:"5" yaml:"max_redirects"`
+	Timeout      int   `default:"3600" yaml:"timeout"` // seconds
+
+	// AllowPrivate allows pulling from loopback, link-local and private
+	// network addresses, which is denied by default so servers cannot reach
+	// services on the node or the internal network.
+	AllowPrivate bool `default:"false" yaml:"allow_private"`
+}
+
+type SearchConfig struct {
+	MaxFileSize int64 `default:"1048576" yaml:"max_file_size"` // 1MB
+	MaxResults  int   `default:"100" yaml:"max_results"`
+}
+
+type TrashConfig struct {
+	Enabled   bool  `default:"true" yaml:"enabled"`
+	Retention int   `default:"168" yaml:"retention"`       // hours
+	MaxSize   int64 `default:"1073741824" yaml:"max_size"` // 1GB
+}
+
+type WatchConfig struct {
+	MaxWatches int `default:"10" yaml:"max_watches"` // per server
+	Debounce   int `default:"250" yaml:"debounce"`   // milliseconds
+}
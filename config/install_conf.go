@@ -0,0 +1,12 @@
+package config
+
+// InstallConfig limits the containers the install scripts of the servers run
+// in, unless their template sets its own limits. Concurrency is how many
+// installs run at the same time, the others wait in the install queue.
+type InstallConfig struct {
+	Concurrency int `default:"2" yaml:"concurrency"`
+
+	Memory  int64 `default:"1073741824" yaml:"memory"` // bytes, 1GB
+	Cpu     int64 `default:"1024" yaml:"cpu"`          // cpu shares
+	Timeout int   `default:"3600" yaml:"timeout"`      // seconds
+}
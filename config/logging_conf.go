@@ -0,0 +1,19 @@
+package config
+
+// LoggingConfig configures the logs of the daemon itself, which are written
+// to the console and to rotating files below the log directory.
+type LoggingConfig struct {
+	Level   string `default:"info" yaml:"level"`
+	Format  string `default:"json" yaml:"format"` // of the files, json or logfmt
+	Console bool   `default:"true" yaml:"console"`
+	File    bool   `default:"true" yaml:"file"`
+
+	MaxSize   int64 `default:"52428800" yaml:"max_size"` // 50MB
+	Compress  bool  `default:"true" yaml:"compress"`
+	MaxFiles  int   `default:"10" yaml:"max_files"`
+	Retention int   `default:"720" yaml:"retention"` // hours
+
+	// Levels overrides the level of single subsystems, such as "http",
+	// "server", "backup", "schedule" or "websocket".
+	Levels map[string]string `yaml:"levels"`
+}
@@ -0,0 +1,9 @@
+package config
+
+// TemplatesConfig configures the repository templates are synced from.
+type TemplatesConfig struct {
+	// Repository is the URL or local directory of the template index. It
+	// can point to the index.json file itself or to the directory of it.
+	Repository string `default:"" yaml:"repository"`
+	Timeout    int    `default:"30" yaml:"timeout"` // seconds
+}
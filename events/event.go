@@ -1,33 +1,60 @@
 package events
 
+import "sync"
+
 var (
-	listeners = make(map[string]func(Event))
+	listenersMu sync.RWMutex
+	listeners   = make(map[string]func(Event))
 
 	ServerCreated = "server.created"
 	ServerDeleted = "server.deleted"
 
-	ServerInstallStarted  = "server.start_install"
-	ServerInstallFinished = "server.finish_install"
+	ServerInstallQueued    = "server.queue_install"
+	ServerImagePull        = "server.image_pull"
+	ServerInstallStarted   = "server.start_install"
+	ServerInstallFinished  = "server.finish_install"
+	ServerInstallFailed    = "server.fail_install"
+	ServerInstallCancelled = "server.cancel_install"
 
 	PowerEvent  = "server.power_action"
 	ServerLog   = "server.log"
 	ServerStats = "server.stats"
+
+	ServerFilePull = "server.file_pull"
+
+	ServerBackupProgress         = "server.backup_progress"
+	ServerBackupCompleted        = "server.backup_completed"
+	ServerBackupRestoreProgress  = "server.backup_restore_progress"
+	ServerBackupRestoreCompleted = "server.backup_restore_completed"
+
+	ServerScheduleLog = "server.schedule_log"
+
+	ServerError = "server.error"
 )
 
+// Event is something that happened in the daemon. Server is the uuid of the
+// server it happened to, if any, so it's only sent to the clients of that
+// server.
 type Event struct {
 	Name    string
+	Server  string
 	Payload interface{}
 }
 
 func Listen(id string, fn func(Event)) func() {
+	listenersMu.Lock()
 	listeners[id] = fn
+	listenersMu.Unlock()
+
 	return func() {
 		Unlisten(id)
 	}
 }
 
 func Unlisten(id string) {
+	listenersMu.Lock()
 	delete(listeners, id)
+	listenersMu.Unlock()
 }
 
 func New(name string, payload interface{}) Event {
@@ -37,8 +64,26 @@ func New(name string, payload interface{}) Event {
 	}
 }
 
+// ForServer returns an event that happened to the server with the given uuid.
+func ForServer(server string, name string, payload interface{}) Event {
+	return Event{
+		Name:    name,
+		Server:  server,
+		Payload: payload,
+	}
+}
+
+// Publish calls every listener with the event. The listeners are called
+// outside of the lock, so they can listen and unlisten themselves.
 func (e Event) Publish() {
+	listenersMu.RLock()
+	fns := make([]func(Event), 0, len(listeners))
 	for _, fn := range listeners {
+		fns = append(fns, fn)
+	}
+	listenersMu.RUnlock()
+
+	for _, fn := range fns {
 		fn(e)
 	}
 }
@@ -0,0 +1,43 @@
+package events
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestPublishWhileListening(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				unlisten := Listen(strconv.Itoa(i)+"-"+strconv.Itoa(j), func(Event) {})
+				unlisten()
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				ForServer("server", ServerLog, nil).Publish()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestForServer(t *testing.T) {
+	var got []Event
+	unlisten := Listen("test", func(e Event) {
+		got = append(got, e)
+	})
+	defer unlisten()
+
+	ForServer("a", ServerLog, "line").Publish()
+	New(ServerCreated, nil).Publish()
+
+	if len(got) != 2 || got[0].Server != "a" || got[0].Payload != "line" || got[1].Server != "" {
+		t.Fatalf("got %+v", got)
+	}
+}
@@ -0,0 +1,189 @@
+package logging
+
+import (
+	"bytes"
+	"daemon/config"
+	"daemon/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apex/log"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubsystemField is the field entries of a subsystem logger carry, which
+// decides the level they are filtered with.
+const SubsystemField = "subsystem"
+
+// For returns the logger of a subsystem of the daemon.
+func For(subsystem string) *log.Entry {
+	return log.WithField(SubsystemField, subsystem)
+}
+
+// handler writes entries in a human readable form to the console and as JSON
+// or logfmt to the log file, filtering them by the level of their subsystem.
+type handler struct {
+	mu      sync.Mutex
+	level   log.Level
+	levels  map[string]log.Level
+	console io.Writer
+	file    io.Writer
+	format  string
+}
+
+// Configure sets up the daemon logs as described by the config. The debug
+// flag of the config overrides every level.
+func Configure(c *config.Config) error {
+	conf := c.Logging
+
+	h := &handler{
+		level:  log.InfoLevel,
+		levels: map[string]log.Level{},
+		format: conf.Format,
+	}
+
+	if conf.Format != "json" && conf.Format != "logfmt" {
+		return errors.New("unknown log format " + conf.Format)
+	}
+
+	if conf.Level != "" {
+		level, err := log.ParseLevel(conf.Level)
+		if err != nil {
+			return err
+		}
+		h.level = level
+	}
+
+	for subsystem, l := range conf.Levels {
+		level, err := log.ParseLevel(l)
+		if err != nil {
+			return fmt.Errorf("invalid level of %s: %w", subsystem, err)
+		}
+		h.levels[subsystem] = level
+	}
+
+	if c.Debug {
+		h.level = log.DebugLevel
+		h.levels = map[string]log.Level{}
+	}
+
+	if conf.Console {
+		h.console = os.Stderr
+	}
+
+	if conf.File {
+		w, err := utils.NewRotatingWriter(utils.Normalize(c.System.LogDirectory), "daemon", utils.RotateOptions{
+			MaxSize:   conf.MaxSize,
+			Compress:  conf.Compress,
+			MaxFiles:  conf.MaxFiles,
+			Retention: time.Duration(conf.Retention) * time.Hour,
+		})
+		if err != nil {
+			return err
+		}
+		h.file = w
+	}
+
+	// entries are filtered by the handler, which knows their subsystem.
+	log.SetLevel(log.DebugLevel)
+	log.SetHandler(h)
+	return nil
+}
+
+func (h *handler) HandleLog(e *log.Entry) error {
+	level := h.level
+	if subsystem, ok := e.Fields[SubsystemField].(string); ok {
+		if l, ok := h.levels[subsystem]; ok {
+			level = l
+		}
+	}
+
+	if e.Level < level {
+		return nil
+	}
+
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.console != nil {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%s %5s %-25s", e.Timestamp.Format("2006/01/02 15:04:05"), e.Level.String(), e.Message)
+		for _, name := range names {
+			fmt.Fprintf(&b, " %s=%v", name, e.Fields[name])
+		}
+		b.WriteByte('\n')
+		_, _ = h.console.Write(b.Bytes())
+	}
+
+	if h.file != nil {
+		var line []byte
+		if h.format == "logfmt" {
+			line = formatLogfmt(e, names)
+		} else {
+			line = formatJSON(e)
+		}
+
+		if _, err := h.file.Write(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatJSON(e *log.Entry) []byte {
+	entry := make(map[string]interface{}, len(e.Fields)+3)
+	for name, value := range e.Fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[name] = value
+	}
+	entry["time"] = e.Timestamp.Format(time.RFC3339Nano)
+	entry["level"] = e.Level.String()
+	entry["message"] = e.Message
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":    e.Timestamp.Format(time.RFC3339Nano),
+			"level":   e.Level.String(),
+			"message": e.Message,
+		})
+	}
+
+	return append(b, '\n')
+}
+
+func formatLogfmt(e *log.Entry, names []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("time=" + e.Timestamp.Format(time.RFC3339Nano))
+	b.WriteString(" level=" + e.Level.String())
+	b.WriteString(" msg=" + logfmtValue(e.Message))
+	for _, name := range names {
+		b.WriteString(" " + name + "=" + logfmtValue(fmt.Sprint(e.Fields[name])))
+	}
+	b.WriteByte('\n')
+
+	return b.Bytes()
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
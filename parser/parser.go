@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var ErrUnknownParser = errors.New("unknown config file parser")
+
+var (
+	intValue   = regexp.MustCompile(`^-?(0|[1-9][0-9]{0,17})$`)
+	floatValue = regexp.MustCompile(`^-?(0|[1-9][0-9]*)\.[0-9]+$`)
+)
+
+// Replacement changes the value at a key of a config file. Match is the key
+// path, with "*" matching any key. When IfValue is set, only values equal to
+// it are replaced.
+type Replacement struct {
+	Match       string `json:"match"`
+	IfValue     string `json:"if_value,omitempty"`
+	ReplaceWith string `json:"replace_with"`
+}
+
+// Parse applies the replacements to the content of a config file of the given
+// format, and returns the new content. The formats are properties, yaml,
+// json, ini, xml and file, which replaces the lines starting with a match.
+func Parse(format string, data []byte, replacements []Replacement) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case "properties":
+		return parseProperties(data, replacements), nil
+	case "yaml", "yml":
+		return parseYaml(data, replacements)
+	case "json":
+		return parseJson(data, replacements)
+	case "ini":
+		return parseIni(data, replacements), nil
+	case "xml":
+		return parseXml(data, replacements)
+	case "file", "":
+		return parseFile(data, replacements), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownParser, format)
+}
+
+// splitPath splits a key path such as "servers.*.address", "listeners[0].host"
+// or "/config/server/port" in its segments. Dots in keys can be escaped with a
+// backslash.
+func splitPath(p string) []string {
+	sep := '.'
+	if strings.HasPrefix(p, "/") {
+		sep = '/'
+		p = p[1:]
+	}
+
+	var segments []string
+	var b strings.Builder
+	escaped := false
+	for _, r := range p {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == sep || r == '[':
+			if b.Len() > 0 {
+				segments = append(segments, b.String())
+			}
+			b.Reset()
+		case r == ']':
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		segments = append(segments, b.String())
+	}
+
+	return segments
+}
+
+// matchKey reports whether a key matches a segment of a key path, which can
+// contain glob wildcards.
+func matchKey(pattern string, key string) bool {
+	if pattern == key {
+		return true
+	}
+
+	ok, err := path.Match(pattern, key)
+	return err == nil && ok
+}
+
+func isPattern(segment string) bool {
+	return strings.ContainsAny(segment, "*?")
+}
+
+// creates reports whether missing keys should be added for the replacement,
+// which is only done for plain key paths.
+func creates(r Replacement) bool {
+	return r.IfValue == "" && !isPattern(r.Match)
+}
+
+// scalarTag returns the YAML tag of a replacement value, so numbers and
+// booleans keep their type in typed formats.
+func scalarTag(v string) string {
+	switch v {
+	case "true", "false":
+		return "!!bool"
+	}
+
+	if intValue.MatchString(v) {
+		return "!!int"
+	}
+
+	if floatValue.MatchString(v) {
+		return "!!float"
+	}
+
+	return "!!str"
+}
+
+// splitLines splits text content in lines, and returns the line ending it
+// uses so it can be joined back the same way.
+func splitLines(data []byte) ([]string, string) {
+	text := string(data)
+	ending := "\n"
+	if strings.Contains(text, "\r\n") {
+		ending = "\r\n"
+	}
+
+	text = strings.TrimSuffix(text, ending)
+	if text == "" {
+		return []string{}, ending
+	}
+
+	return strings.Split(text, ending), ending
+}
+
+func joinLines(lines []string, ending string) []byte {
+	if len(lines) == 0 {
+		return []byte{}
+	}
+
+	return []byte(strings.Join(lines, ending) + ending)
+}
@@ -0,0 +1,358 @@
+package parser
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "server.port", want: []string{"server", "port"}},
+		{path: "servers.*.address", want: []string{"servers", "*", "address"}},
+		{path: "listeners[0].host", want: []string{"listeners", "0", "host"}},
+		{path: "/config/server/port", want: []string{"config", "server", "port"}},
+		{path: "/config/a.b", want: []string{"config", "a.b"}},
+		{path: `settings.some\.key`, want: []string{"settings", "some.key"}},
+		{path: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		if got := splitPath(tt.path); !slices.Equal(got, tt.want) {
+			t.Errorf("splitPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name         string
+		format       string
+		in           string
+		replacements []Replacement
+		want         string
+	}{
+		// properties
+		{
+			name:         "properties value",
+			format:       "properties",
+			in:           "motd=Hello\nserver-port = 25565\n",
+			replacements: []Replacement{{Match: "server-port", ReplaceWith: "25566"}},
+			want:         "motd=Hello\nserver-port = 25566\n",
+		},
+		{
+			name:         "properties missing key",
+			format:       "properties",
+			in:           "a=1\n",
+			replacements: []Replacement{{Match: "b", ReplaceWith: "2"}},
+			want:         "a=1\nb=2\n",
+		},
+		{
+			name:         "properties comments",
+			format:       "properties",
+			in:           "#port=1\n! port=1\nport=2\n",
+			replacements: []Replacement{{Match: "port", ReplaceWith: "3"}},
+			want:         "#port=1\n! port=1\nport=3\n",
+		},
+		{
+			name:         "properties if value",
+			format:       "properties",
+			in:           "online-mode=true\nsnooper=false\n",
+			replacements: []Replacement{{Match: "online-mode", IfValue: "false", ReplaceWith: "true"}, {Match: "snooper", IfValue: "false", ReplaceWith: "true"}, {Match: "missing", IfValue: "x", ReplaceWith: "y"}},
+			want:         "online-mode=true\nsnooper=true\n",
+		},
+		{
+			name:         "properties wildcard",
+			format:       "properties",
+			in:           "rcon.port=1\nquery.port=2\nother=3\n",
+			replacements: []Replacement{{Match: "*.port", ReplaceWith: "9"}, {Match: "missing.*", ReplaceWith: "9"}},
+			want:         "rcon.port=9\nquery.port=9\nother=3\n",
+		},
+		{
+			name:         "properties crlf",
+			format:       "properties",
+			in:           "a=1\r\nb=2\r\n",
+			replacements: []Replacement{{Match: "b", ReplaceWith: "3"}, {Match: "c", ReplaceWith: "4"}},
+			want:         "a=1\r\nb=3\r\nc=4\r\n",
+		},
+		{
+			name:         "properties empty",
+			format:       "properties",
+			in:           "",
+			replacements: []Replacement{{Match: "key", ReplaceWith: "v"}},
+			want:         "key=v\n",
+		},
+
+		// ini
+		{
+			name:         "ini section key",
+			format:       "ini",
+			in:           "[server]\nport = 1\n\n[db]\nhost=x\n",
+			replacements: []Replacement{{Match: "server.port", ReplaceWith: "2"}},
+			want:         "[server]\nport = 2\n\n[db]\nhost=x\n",
+		},
+		{
+			name:         "ini missing key",
+			format:       "ini",
+			in:           "[server]\nport = 1\n\n[db]\nhost=x\n",
+			replacements: []Replacement{{Match: "server.name", ReplaceWith: "a"}},
+			want:         "[server]\nport = 1\nname = a\n\n[db]\nhost=x\n",
+		},
+		{
+			name:         "ini missing section",
+			format:       "ini",
+			in:           "[a]\nx=1\n",
+			replacements: []Replacement{{Match: "b.y", ReplaceWith: "2"}},
+			want:         "[a]\nx=1\n\n[b]\ny=2\n",
+		},
+		{
+			name:         "ini keys without section",
+			format:       "ini",
+			in:           "top=1\n[a]\ntop=5\n",
+			replacements: []Replacement{{Match: "top", ReplaceWith: "2"}, {Match: "new", ReplaceWith: "3"}},
+			want:         "top=2\nnew=3\n[a]\ntop=5\n",
+		},
+		{
+			name:         "ini wildcard",
+			format:       "ini",
+			in:           "[a]\nport=1\n[b]\nport=2\nhost=x\n",
+			replacements: []Replacement{{Match: "*.port", ReplaceWith: "3"}},
+			want:         "[a]\nport=3\n[b]\nport=3\nhost=x\n",
+		},
+		{
+			name:         "ini if value",
+			format:       "ini",
+			in:           "[a]\npvp=true\n[b]\npvp=false\n",
+			replacements: []Replacement{{Match: "*.pvp", IfValue: "false", ReplaceWith: "true"}},
+			want:         "[a]\npvp=true\n[b]\npvp=true\n",
+		},
+		{
+			name:         "ini crlf",
+			format:       "ini",
+			in:           "; comment\r\n[a]\r\nx=1\r\n",
+			replacements: []Replacement{{Match: "a.x", ReplaceWith: "2"}, {Match: "a.y", ReplaceWith: "3"}},
+			want:         "; comment\r\n[a]\r\nx=2\r\ny=3\r\n",
+		},
+
+		// yaml
+		{
+			name:         "yaml nested",
+			format:       "yaml",
+			in:           "server:\n  port: 25565\n  host: \"0.0.0.0\"\n",
+			replacements: []Replacement{{Match: "server.port", ReplaceWith: "25566"}},
+			want:         "server:\n  port: 25566\n  host: \"0.0.0.0\"\n",
+		},
+		{
+			name:         "yaml quoted stays string",
+			format:       "yaml",
+			in:           "host: \"0.0.0.0\"\nname: x\n",
+			replacements: []Replacement{{Match: "host", ReplaceWith: "127"}, {Match: "name", ReplaceWith: "true"}},
+			want:         "host: \"127\"\nname: true\n",
+		},
+		{
+			name:         "yaml missing path",
+			format:       "yml",
+			in:           "a: 1\n",
+			replacements: []Replacement{{Match: "b.c", ReplaceWith: "d"}},
+			want:         "a: 1\nb:\n  c: d\n",
+		},
+		{
+			name:         "yaml sequence",
+			format:       "yaml",
+			in:           "servers:\n  - port: 1\n  - port: 2\n",
+			replacements: []Replacement{{Match: "servers.*.port", ReplaceWith: "3"}, {Match: "servers[1].port", ReplaceWith: "4"}},
+			want:         "servers:\n  - port: 3\n  - port: 4\n",
+		},
+		{
+			name:         "yaml if value",
+			format:       "yaml",
+			in:           "a: 1\nb: 2\n",
+			replacements: []Replacement{{Match: "*", IfValue: "2", ReplaceWith: "3"}},
+			want:         "a: 1\nb: 3\n",
+		},
+		{
+			name:         "yaml comments",
+			format:       "yaml",
+			in:           "# settings\na: 1 # the value\n",
+			replacements: []Replacement{{Match: "a", ReplaceWith: "2"}},
+			want:         "# settings\na: 2 # the value\n",
+		},
+		{
+			name:         "yaml empty",
+			format:       "yaml",
+			in:           "",
+			replacements: []Replacement{{Match: "a.b", ReplaceWith: "c"}},
+			want:         "a:\n  b: c\n",
+		},
+
+		// json
+		{
+			name:         "json keeps order and types",
+			format:       "json",
+			in:           `{"b": 1, "a": {"x": "s", "y": null}}`,
+			replacements: []Replacement{{Match: "a.x", ReplaceWith: "t"}, {Match: "b", ReplaceWith: "2"}},
+			want:         "{\n  \"b\": 2,\n  \"a\": {\n    \"x\": \"t\",\n    \"y\": null\n  }\n}\n",
+		},
+		{
+			name:         "json string stays string",
+			format:       "json",
+			in:           `{"port": "1", "float": 1.5}`,
+			replacements: []Replacement{{Match: "port", ReplaceWith: "2"}},
+			want:         "{\n  \"port\": \"2\",\n  \"float\": 1.5\n}\n",
+		},
+		{
+			name:         "json array",
+			format:       "json",
+			in:           `{"l": [{"p": 1}, {"p": 2}], "e": []}`,
+			replacements: []Replacement{{Match: "l.*.p", ReplaceWith: "3"}},
+			want:         "{\n  \"l\": [\n    {\n      \"p\": 3\n    },\n    {\n      \"p\": 3\n    }\n  ],\n  \"e\": []\n}\n",
+		},
+		{
+			name:         "json missing path",
+			format:       "json",
+			in:           `{}`,
+			replacements: []Replacement{{Match: "a.b", ReplaceWith: "true"}, {Match: "*.c", ReplaceWith: "x"}},
+			want:         "{\n  \"a\": {\n    \"b\": true\n  }\n}\n",
+		},
+		{
+			name:         "json empty",
+			format:       "json",
+			in:           "",
+			replacements: []Replacement{{Match: "a", ReplaceWith: "<b>"}},
+			want:         "{\n  \"a\": \"<b>\"\n}\n",
+		},
+
+		// xml
+		{
+			name:         "xml element",
+			format:       "xml",
+			in:           "<?xml version=\"1.0\"?>\n<config>\n  <!-- the port -->\n  <port>1</port>\n</config>\n",
+			replacements: []Replacement{{Match: "config.port", ReplaceWith: "2"}},
+			want:         "<?xml version=\"1.0\"?>\n<config>\n  <!-- the port -->\n  <port>2</port>\n</config>\n",
+		},
+		{
+			name:         "xml slash path",
+			format:       "xml",
+			in:           "<config><server.name>a</server.name></config>",
+			replacements: []Replacement{{Match: "/config/server.name", ReplaceWith: "b & c"}},
+			want:         "<config><server.name>b &amp; c</server.name></config>",
+		},
+		{
+			name:         "xml attribute",
+			format:       "xml",
+			in:           "<config><server port=\"1\"/></config>",
+			replacements: []Replacement{{Match: "config.server.@port", ReplaceWith: "2"}, {Match: "config.server.@host", ReplaceWith: "\"x\""}},
+			want:         "<config><server port=\"2\" host=\"&quot;x&quot;\"/></config>",
+		},
+		{
+			name:         "xml missing element",
+			format:       "xml",
+			in:           "<config>\n</config>",
+			replacements: []Replacement{{Match: "config.a.b", ReplaceWith: "c"}, {Match: "other", ReplaceWith: "x"}},
+			want:         "<config>\n<a><b>c</b></a></config>",
+		},
+		{
+			name:         "xml wildcard and if value",
+			format:       "xml",
+			in:           "<c><a on=\"false\"/><b on=\"true\"/><d>false</d><e>true</e></c>",
+			replacements: []Replacement{{Match: "c.*.@on", IfValue: "false", ReplaceWith: "yes"}, {Match: "c.*", IfValue: "true", ReplaceWith: "no"}},
+			want:         "<c><a on=\"yes\"/><b on=\"true\"/><d>false</d><e>no</e></c>",
+		},
+		{
+			name:         "xml namespaces",
+			format:       "xml",
+			in:           "<c xmlns:x=\"urn:x\"><x:port>1</x:port></c>",
+			replacements: []Replacement{{Match: "c.x:port", ReplaceWith: "2"}},
+			want:         "<c xmlns:x=\"urn:x\"><x:port>2</x:port></c>",
+		},
+
+		// file
+		{
+			name:         "file line",
+			format:       "file",
+			in:           "port=1\nmotd=x\n",
+			replacements: []Replacement{{Match: "port=", ReplaceWith: "port=2"}},
+			want:         "port=2\nmotd=x\n",
+		},
+		{
+			name:         "file if value",
+			format:       "",
+			in:           "java -Xmx1G -jar server.jar\n",
+			replacements: []Replacement{{Match: "java", IfValue: "1G", ReplaceWith: "2G"}},
+			want:         "java -Xmx2G -jar server.jar\n",
+		},
+		{
+			name:         "file crlf",
+			format:       "file",
+			in:           "a\r\nport 1\r\n",
+			replacements: []Replacement{{Match: "port", ReplaceWith: "port 2"}, {Match: "missing", ReplaceWith: "x"}},
+			want:         "a\r\nport 2\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.format, []byte(tt.in), tt.replacements)
+			if err != nil {
+				t.Fatalf("Parse() failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("Parse() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseRoundTrip checks that a file without replacements is written back
+// as it was.
+func TestParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		format string
+		in     string
+	}{
+		{format: "properties", in: "# comment\nkey = value\n\nother:x\r\n"},
+		{format: "ini", in: "; comment\r\n[a]\r\nx = 1\r\n\r\n[b]\r\ny=2\r\n"},
+		{format: "yaml", in: "# comment\na:\n  - 1\n  - \"two\"\nb: {c: d}\n"},
+		{format: "json", in: "{\n  \"a\": [\n    1,\n    \"two\"\n  ],\n  \"b\": {}\n}\n"},
+		{format: "xml", in: "<?xml version=\"1.0\"?>\n<!DOCTYPE c>\n<c a=\"1\">\n  <!-- x -->\n  <d/>\n  <e>t &lt; u</e>\n</c>\n"},
+		{format: "file", in: "anything\r\ngoes\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := Parse(tt.format, []byte(tt.in), nil)
+			if err != nil {
+				t.Fatalf("Parse() failed: %v", err)
+			}
+			if string(got) != tt.in {
+				t.Fatalf("Parse() =\n%q\nwant\n%q", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		in     string
+	}{
+		{format: "toml", in: "a = 1"},
+		{format: "json", in: `{"a": 1} {}`},
+		{format: "json", in: `{"a": `},
+		{format: "yaml", in: "a: [1"},
+		{format: "xml", in: "<a><b"},
+	}
+
+	for _, tt := range tests {
+		if _, err := Parse(tt.format, []byte(tt.in), nil); err == nil {
+			t.Errorf("Parse(%s, %q) didn't fail", tt.format, tt.in)
+		}
+	}
+
+	if _, err := Parse("toml", nil, nil); !errors.Is(err, ErrUnknownParser) {
+		t.Errorf("Parse() = %v, want ErrUnknownParser", err)
+	}
+}
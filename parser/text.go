@@ -0,0 +1,191 @@
+package parser
+
+import (
+	"strings"
+)
+
+func parseProperties(data []byte, replacements []Replacement) []byte {
+	lines, ending := splitLines(data)
+
+	for _, r := range replacements {
+		found := false
+		for i, line := range lines {
+			key, value, prefix, ok := propertyLine(line)
+			if !ok || !matchKey(r.Match, key) {
+				continue
+			}
+
+			found = true
+			if r.IfValue != "" && value != r.IfValue {
+				continue
+			}
+			lines[i] = prefix + r.ReplaceWith
+		}
+
+		if !found && creates(r) {
+			lines = append(lines, r.Match+"="+r.ReplaceWith)
+		}
+	}
+
+	return joinLines(lines, ending)
+}
+
+// propertyLine splits a line of a properties file in its key and value, and
+// returns the part of the line before the value.
+func propertyLine(line string) (string, string, string, bool) {
+	trimmed := strings.TrimLeft(line, " \t")
+	if trimmed == "" || trimmed[0] == '#' || trimmed[0] == '!' {
+		return "", "", "", false
+	}
+
+	i := strings.IndexAny(line, "=:")
+	if i == -1 {
+		return "", "", "", false
+	}
+
+	value := strings.TrimLeft(line[i+1:], " \t")
+	return strings.TrimSpace(line[:i]), strings.TrimRight(value, " \t"), line[:len(line)-len(value)], true
+}
+
+type iniLine struct {
+	section string
+	header  bool
+	key     string
+	value   string
+	prefix  string
+}
+
+func parseIni(data []byte, replacements []Replacement) []byte {
+	lines, ending := splitLines(data)
+
+	for _, r := range replacements {
+		segments := splitPath(r.Match)
+		if len(segments) == 0 {
+			continue
+		}
+		section := strings.Join(segments[:len(segments)-1], ".")
+		key := segments[len(segments)-1]
+
+		found := false
+		for i, l := range scanIni(lines) {
+			if l.key == "" || !matchKey(section, l.section) || !matchKey(key, l.key) {
+				continue
+			}
+
+			found = true
+			if r.IfValue != "" && l.value != r.IfValue {
+				continue
+			}
+			lines[i] = l.prefix + r.ReplaceWith
+		}
+
+		if !found && creates(r) {
+			lines = insertIni(lines, section, key+iniSeparator(lines)+r.ReplaceWith)
+		}
+	}
+
+	return joinLines(lines, ending)
+}
+
+func scanIni(lines []string) []iniLine {
+	scanned := make([]iniLine, len(lines))
+
+	section := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			scanned[i] = iniLine{section: section, header: true}
+			continue
+		}
+		scanned[i] = iniLine{section: section}
+
+		if trimmed == "" || trimmed[0] == ';' || trimmed[0] == '#' {
+			continue
+		}
+
+		j := strings.IndexByte(line, '=')
+		if j == -1 {
+			j = strings.IndexByte(line, ':')
+		}
+		if j == -1 {
+			continue
+		}
+
+		value := strings.TrimLeft(line[j+1:], " \t")
+		scanned[i].key = strings.TrimSpace(line[:j])
+		scanned[i].value = strings.TrimRight(value, " \t")
+		scanned[i].prefix = line[:len(line)-len(value)]
+	}
+
+	return scanned
+}
+
+// iniSeparator returns the separator between keys and values the file uses.
+func iniSeparator(lines []string) string {
+	for _, l := range scanIni(lines) {
+		if l.key != "" && strings.HasSuffix(l.prefix, " = ") {
+			return " = "
+		}
+	}
+
+	return "="
+}
+
+// insertIni adds a line at the end of a section, adding the section when it
+// doesn't exist. Keys without a section go before the first one.
+func insertIni(lines []string, section string, line string) []string {
+	scanned := scanIni(lines)
+
+	start := -1
+	if section == "" {
+		start = 0
+	} else {
+		for i, l := range scanned {
+			if l.header && l.section == section {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	if start == -1 {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		return append(lines, "["+section+"]", line)
+	}
+
+	end := start
+	for end < len(lines) && !scanned[end].header {
+		end++
+	}
+	for end > start && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+
+	lines = append(lines[:end], append([]string{line}, lines[end:]...)...)
+	return lines
+}
+
+// parseFile replaces the lines that start with a match. With an IfValue, only
+// that part of the line is replaced.
+func parseFile(data []byte, replacements []Replacement) []byte {
+	lines, ending := splitLines(data)
+
+	for _, r := range replacements {
+		for i, line := range lines {
+			if !strings.HasPrefix(line, r.Match) {
+				continue
+			}
+
+			if r.IfValue != "" {
+				lines[i] = strings.ReplaceAll(line, r.IfValue, r.ReplaceWith)
+			} else {
+				lines[i] = r.ReplaceWith
+			}
+		}
+	}
+
+	return joinLines(lines, ending)
+}
@@ -0,0 +1,251 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strconv"
+	"strings"
+)
+
+func parseYaml(data []byte, replacements []Replacement) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		doc = yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}},
+		}
+	}
+
+	for _, r := range replacements {
+		if segments := splitPath(r.Match); len(segments) > 0 {
+			setNode(doc.Content[0], segments, r)
+		}
+	}
+
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// parseJson reads the JSON in a YAML node tree, so it is edited the same way
+// as YAML while the order of the keys is kept.
+func parseJson(data []byte, replacements []Replacement) ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(bytes.TrimSpace(data)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+
+		var err error
+		if root, err = decodeJson(dec); err != nil {
+			return nil, err
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errors.New("invalid data after the top-level value")
+		}
+	}
+
+	for _, r := range replacements {
+		if segments := splitPath(r.Match); len(segments) > 0 {
+			setNode(root, segments, r)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := encodeJson(&b, root, ""); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+
+	return b.Bytes(), nil
+}
+
+// setNode applies a replacement to the nodes at the remaining segments of its
+// key path below n.
+func setNode(n *yaml.Node, segments []string, r Replacement) {
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+
+	if len(segments) == 0 {
+		if n.Kind == yaml.ScalarNode && r.IfValue != "" && n.Value != r.IfValue {
+			return
+		}
+		if n.Kind != yaml.ScalarNode && r.IfValue != "" {
+			return
+		}
+
+		setScalar(n, r.ReplaceWith)
+		return
+	}
+
+	segment := segments[0]
+	switch n.Kind {
+	case yaml.MappingNode:
+		found := false
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if matchKey(segment, n.Content[i].Value) {
+				found = true
+				setNode(n.Content[i+1], segments[1:], r)
+			}
+		}
+
+		if !found && creates(r) {
+			value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: segment}, value)
+			setNode(value, segments[1:], r)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			if matchKey(segment, strconv.Itoa(i)) {
+				setNode(c, segments[1:], r)
+			}
+		}
+	case yaml.ScalarNode:
+		// a key can be added below an empty value.
+		if n.Tag == "!!null" && creates(r) {
+			*n = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setNode(n, segments, r)
+		}
+	}
+}
+
+// setScalar sets the value of a node. Values that were quoted strings stay
+// strings, others get the type their new value looks like.
+func setScalar(n *yaml.Node, v string) {
+	quoted := n.Kind == yaml.ScalarNode && n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0
+
+	n.Kind = yaml.ScalarNode
+	n.Value = v
+	n.Content = nil
+	n.Alias = nil
+	if quoted {
+		n.Tag = "!!str"
+	} else {
+		n.Tag = scalarTag(v)
+		n.Style = 0
+	}
+}
+
+func decodeJson(dec *json.Decoder) (*yaml.Node, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := t.(type) {
+	case json.Delim:
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		if v == '[' {
+			n = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		}
+
+		for dec.More() {
+			if n.Kind == yaml.MappingNode {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+
+			value, err := decodeJson(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, value)
+		}
+
+		// the closing delimiter.
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v, Style: yaml.DoubleQuotedStyle}, nil
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(v.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: v.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}, nil
+	}
+
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
+
+func encodeJson(b *bytes.Buffer, n *yaml.Node, indent string) error {
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, end := "{", "}"
+		step := 2
+		if n.Kind == yaml.SequenceNode {
+			open, end = "[", "]"
+			step = 1
+		}
+
+		if len(n.Content) == 0 {
+			b.WriteString(open + end)
+			return nil
+		}
+
+		b.WriteString(open + "\n")
+		inner := indent + "  "
+		for i := 0; i+step-1 < len(n.Content); i += step {
+			if i > 0 {
+				b.WriteString(",\n")
+			}
+			b.WriteString(inner)
+
+			if step == 2 {
+				b.WriteString(quoteJson(n.Content[i].Value) + ": ")
+			}
+			if err := encodeJson(b, n.Content[i+step-1], inner); err != nil {
+				return err
+			}
+		}
+		b.WriteString("\n" + indent + end)
+	case yaml.ScalarNode:
+		switch n.Tag {
+		case "!!int", "!!float", "!!bool":
+			b.WriteString(n.Value)
+		case "!!null":
+			b.WriteString("null")
+		default:
+			b.WriteString(quoteJson(n.Value))
+		}
+	default:
+		return errors.New("unsupported json value")
+	}
+
+	return nil
+}
+
+func quoteJson(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
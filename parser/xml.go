@@ -0,0 +1,181 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+var (
+	xmlText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	xmlAttr = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;", "\n", "&#xA;")
+)
+
+// xmlNode is an element of an XML document, or any other token in it. The
+// tokens are kept as they are so the document is written back unchanged
+// besides the replaced values.
+type xmlNode struct {
+	token    xml.Token
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlNode
+}
+
+func (n *xmlNode) element() bool {
+	return n.token == nil
+}
+
+// text returns the text content of an element.
+func (n *xmlNode) text() string {
+	var b strings.Builder
+	for _, c := range n.children {
+		if data, ok := c.token.(xml.CharData); ok {
+			b.Write(data)
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+func parseXml(data []byte, replacements []Replacement) ([]byte, error) {
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+
+	// raw tokens keep the namespace prefixes as they are written.
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		t, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		parent := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name, attrs: t.Attr}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			parent.children = append(parent.children, &xmlNode{token: xml.CopyToken(t)})
+		}
+	}
+
+	for _, r := range replacements {
+		if segments := splitPath(r.Match); len(segments) > 0 {
+			setXml(root, segments, r)
+		}
+	}
+
+	var b bytes.Buffer
+	for _, c := range root.children {
+		writeXml(&b, c)
+	}
+
+	return b.Bytes(), nil
+}
+
+// setXml applies a replacement to the elements at the remaining segments of
+// its key path below n. A last segment starting with "@" is an attribute.
+func setXml(n *xmlNode, segments []string, r Replacement) {
+	if len(segments) == 0 {
+		if r.IfValue != "" && n.text() != r.IfValue {
+			return
+		}
+
+		n.children = []*xmlNode{{token: xml.CharData(r.ReplaceWith)}}
+		return
+	}
+
+	segment := segments[0]
+	if len(segments) == 1 && strings.HasPrefix(segment, "@") {
+		setXmlAttr(n, segment[1:], r)
+		return
+	}
+
+	found := false
+	for _, c := range n.children {
+		if c.element() && matchKey(segment, xmlName(c.name)) {
+			found = true
+			setXml(c, segments[1:], r)
+		}
+	}
+
+	// only one root element can exist.
+	if !found && creates(r) && n.name.Local != "" {
+		c := &xmlNode{name: xml.Name{Local: segment}}
+		n.children = append(n.children, c)
+		setXml(c, segments[1:], r)
+	}
+}
+
+func setXmlAttr(n *xmlNode, name string, r Replacement) {
+	found := false
+	for i, a := range n.attrs {
+		if !matchKey(name, xmlName(a.Name)) {
+			continue
+		}
+
+		found = true
+		if r.IfValue == "" || a.Value == r.IfValue {
+			n.attrs[i].Value = r.ReplaceWith
+		}
+	}
+
+	if !found && creates(r) {
+		n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: r.ReplaceWith})
+	}
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+
+	return name.Local
+}
+
+func writeXml(b *bytes.Buffer, n *xmlNode) {
+	switch t := n.token.(type) {
+	case xml.CharData:
+		b.WriteString(xmlText.Replace(string(t)))
+		return
+	case xml.Comment:
+		b.WriteString("<!--" + string(t) + "-->")
+		return
+	case xml.ProcInst:
+		b.WriteString("<?" + t.Target)
+		if len(t.Inst) > 0 {
+			b.WriteString(" " + string(t.Inst))
+		}
+		b.WriteString("?>")
+		return
+	case xml.Directive:
+		b.WriteString("<!" + string(t) + ">")
+		return
+	}
+
+	b.WriteString("<" + xmlName(n.name))
+	for _, a := range n.attrs {
+		b.WriteString(" " + xmlName(a.Name) + "=\"")
+		b.WriteString(xmlAttr.Replace(a.Value))
+		b.WriteString("\"")
+	}
+
+	if len(n.children) == 0 {
+		b.WriteString("/>")
+		return
+	}
+
+	b.WriteString(">")
+	for _, c := range n.children {
+		writeXml(b, c)
+	}
+	b.WriteString("</" + xmlName(n.name) + ">")
+}
@@ -0,0 +1,184 @@
+package router
+
+import (
+	"daemon/backup"
+	"daemon/server"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func getBackups(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	backups, err := backup.List(s)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list backups: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"backups": backups,
+	})
+}
+
+func createBackup(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	var request struct {
+		Ignored []string `json:"ignored"`
+		Adapter string   `json:"adapter"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	b, err := backup.Create(s, request.Ignored, request.Adapter)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, backup.ErrBackupInProgress) {
+			status = http.StatusConflict
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to create backup: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, b)
+}
+
+func getBackup(c *gin.Context) {
+	b, ok := backupFromRequest(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+func downloadBackup(c *gin.Context) {
+	b, ok := backupFromRequest(c)
+	if !ok {
+		return
+	}
+
+	r, err := b.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open backup: " + err.Error()})
+		return
+	}
+	defer r.Close()
+
+	if b.Compressed() {
+		c.Header("Content-Disposition", "attachment; filename=\""+b.Uuid+".tar.gz\"")
+		c.Header("Content-Type", "application/gzip")
+	} else {
+		c.Header("Content-Disposition", "attachment; filename=\""+b.Uuid+".tar\"")
+		c.Header("Content-Type", "application/x-tar")
+	}
+	c.Header("Content-Length", strconv.FormatInt(b.Size, 10))
+	c.Status(http.StatusOK)
+	_, _ = io.Copy(c.Writer, r)
+}
+
+func verifyBackup(c *gin.Context) {
+	b, ok := backupFromRequest(c)
+	if !ok {
+		return
+	}
+
+	if err := b.Verify(); err != nil {
+		if errors.Is(err, backup.ErrBackupCorrupted) {
+			c.JSON(http.StatusOK, gin.H{"valid": false, "error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify backup: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true})
+}
+
+func restoreBackup(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+	b, ok := backupFromRequest(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Truncate bool `json:"truncate"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	if err := b.Restore(s, request.Truncate); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, backup.ErrBackupInProgress) {
+			status = http.StatusConflict
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to restore backup: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Backup restore started"})
+}
+
+func deleteBackup(c *gin.Context) {
+	b, ok := backupFromRequest(c)
+	if !ok {
+		return
+	}
+
+	if err := b.Delete(); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, backup.ErrBackupInProgress) {
+			status = http.StatusConflict
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to delete backup: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Backup deleted successfully"})
+}
+
+func collectBackupChunks(c *gin.Context) {
+	removed, freed, err := backup.CollectGarbage()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to collect backup chunks: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"removed": removed,
+		"freed":   freed,
+	})
+}
+
+func backupFromRequest(c *gin.Context) (*backup.Backup, bool) {
+	s := c.MustGet("server").(*server.Server)
+
+	b, err := backup.Get(s, c.Param("backup"))
+	if err != nil {
+		if errors.Is(err, backup.ErrBackupNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get backup: " + err.Error()})
+		}
+		return nil, false
+	}
+
+	return b, true
+}
@@ -2,7 +2,9 @@ package router
 
 import (
 	"daemon/server"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"os"
 )
 
 func getFiles(c *gin.Context) {
@@ -24,15 +26,21 @@ func getFileContent(c *gin.Context) {
 	s := c.MustGet("server").(*server.Server)
 	path := c.Query("path")
 
-	fileName, content, err := s.ReadFileContent(path)
+	fileName, content, etag, err := s.ReadFileContent(path)
+	if errors.Is(err, server.ErrPathOutsideVolume) {
+		c.JSON(403, gin.H{"error": "Failed to read file content: " + err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to read file content: " + err.Error()})
 		return
 	}
 
+	c.Header("ETag", etag)
 	c.JSON(200, gin.H{
 		"name":    fileName,
 		"content": content,
+		"etag":    etag,
 	})
 }
 
@@ -48,10 +56,176 @@ func saveFileContent(c *gin.Context) {
 		return
 	}
 
-	if err := s.WriteFileContent(path, request.Content); err != nil {
+	etag, err := s.WriteFileContent(path, request.Content, c.GetHeader("If-Match"))
+	if errors.Is(err, server.ErrFileConflict) {
+		fileName, content, current, err := s.ReadFileContent(path)
+		if err != nil {
+			c.JSON(412, gin.H{"error": "File has been modified or deleted since it was read"})
+			return
+		}
+
+		c.Header("ETag", current)
+		c.JSON(412, gin.H{
+			"error":   "File has been modified since it was read",
+			"name":    fileName,
+			"content": content,
+			"etag":    current,
+		})
+		return
+	}
+
+	if errors.Is(err, server.ErrPathOutsideVolume) {
+		c.JSON(403, gin.H{"error": "Failed to save file content: " + err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to save file content: " + err.Error()})
 		return
 	}
 
-	c.JSON(200, gin.H{"message": "File content saved successfully"})
+	c.Header("ETag", etag)
+	c.JSON(200, gin.H{"message": "File content saved successfully", "etag": etag})
+}
+
+func pullRemoteFile(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	var request struct {
+		Url       string `json:"url" binding:"required"`
+		Directory string `json:"directory"`
+		FileName  string `json:"file_name"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+
+	p, err := s.PullFile(request.Url, request.Directory, request.FileName)
+	if err != nil {
+		status := 500
+		switch {
+		case errors.Is(err, server.ErrPullInProgress):
+			status = 409
+		case errors.Is(err, server.ErrPullTooLarge):
+			status = 413
+		case errors.Is(err, server.ErrDiskQuota):
+			status = 507
+		case errors.Is(err, server.ErrPullDenied), errors.Is(err, server.ErrPullDisabled),
+			errors.Is(err, server.ErrPathOutsideVolume):
+			status = 403
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to pull remote file: " + err.Error()})
+		return
+	}
+
+	c.JSON(202, p)
+}
+
+func searchFiles(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+	regex := c.Query("regex") == "true"
+
+	matches, truncated, err := s.SearchFiles(c.Request.Context(), c.Query("path"), c.Query("pattern"), c.Query("glob"), regex)
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			return
+		}
+
+		status := 500
+		switch {
+		case errors.Is(err, server.ErrInvalidSearch):
+			status = 400
+		case errors.Is(err, server.ErrPathOutsideVolume):
+			status = 403
+		case errors.Is(err, os.ErrNotExist):
+			status = 404
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to search files: " + err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"matches":   matches,
+		"truncated": truncated,
+	})
+}
+
+func deleteFile(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	if err := s.DeleteFile(c.Query("path")); err != nil {
+		if os.IsNotExist(err) {
+			c.JSON(404, gin.H{"error": "File not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"error": "Failed to delete file: " + err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "File deleted successfully"})
+}
+
+func getTrash(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	items, err := s.ListTrash()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list trash: " + err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"items": items,
+	})
+}
+
+func restoreTrash(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	var request struct {
+		Path string `json:"path"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	item, err := s.RestoreTrash(c.Param("item"), request.Path)
+	if err != nil {
+		status := 500
+		switch {
+		case errors.Is(err, server.ErrTrashItemNotFound):
+			status = 404
+		case errors.Is(err, server.ErrFileExists):
+			status = 409
+		case errors.Is(err, server.ErrPathOutsideVolume):
+			status = 403
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to restore file: " + err.Error()})
+		return
+	}
+
+	c.JSON(200, item)
+}
+
+func purgeTrash(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	if err := s.PurgeTrash(c.Param("item")); err != nil {
+		if errors.Is(err, server.ErrTrashItemNotFound) {
+			c.JSON(404, gin.H{"error": "Trash item not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"error": "Failed to purge trash: " + err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Trash purged successfully"})
 }
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"daemon/schedule"
+	"daemon/server"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type scheduleRequest struct {
+	Name           string          `json:"name"`
+	Cron           string          `json:"cron"`
+	Enabled        *bool           `json:"enabled"`
+	OnlyWhenOnline bool            `json:"only_when_online"`
+	Tasks          []schedule.Task `json:"tasks"`
+}
+
+func (r scheduleRequest) schedule() schedule.Schedule {
+	enabled := true
+	if r.Enabled != nil {
+		enabled = *r.Enabled
+	}
+
+	return schedule.Schedule{
+		Name:           r.Name,
+		Cron:           r.Cron,
+		Enabled:        enabled,
+		OnlyWhenOnline: r.OnlyWhenOnline,
+		Tasks:          r.Tasks,
+	}
+}
+
+func getSchedules(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	c.JSON(http.StatusOK, gin.H{
+		"schedules": schedule.List(s),
+	})
+}
+
+func createSchedule(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	var request scheduleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+
+	sc, err := schedule.Create(s, request.schedule())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to create schedule: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, sc)
+}
+
+func getSchedule(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	sc, err := schedule.Get(s, c.Param("schedule"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sc)
+}
+
+func updateSchedule(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	var request scheduleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+
+	sc, err := schedule.Update(s, c.Param("schedule"), request.schedule())
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, schedule.ErrScheduleNotFound) {
+			status = http.StatusNotFound
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to update schedule: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sc)
+}
+
+func runSchedule(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	if err := schedule.Run(s, c.Param("schedule")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, schedule.ErrScheduleNotFound) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, schedule.ErrScheduleRunning) {
+			status = http.StatusConflict
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to run schedule: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Schedule started"})
+}
+
+func deleteSchedule(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	if err := schedule.Delete(s, c.Param("schedule")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, schedule.ErrScheduleNotFound) {
+			status = http.StatusNotFound
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to delete schedule: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted successfully"})
+}
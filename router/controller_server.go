@@ -2,8 +2,13 @@ package router
 
 import (
 	"daemon/server"
+	"daemon/templates"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 func getServers(c *gin.Context) {
@@ -21,3 +26,118 @@ func getServerStats(c *gin.Context) {
 
 	c.JSON(http.StatusOK, stats)
 }
+
+func getConsoleLogs(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	logs, err := s.ConsoleLogs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list console logs: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"logs": logs,
+	})
+}
+
+func downloadConsoleLog(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	f, err := s.OpenConsoleLog(c.Param("name"))
+	if err != nil {
+		if errors.Is(err, server.ErrConsoleLogNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Console log not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open console log: " + err.Error()})
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open console log: " + err.Error()})
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if strings.HasSuffix(info.Name(), ".gz") {
+		contentType = "application/gzip"
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+s.Id+"-"+info.Name()+"\"")
+	c.Header("Content-Length", strconv.FormatInt(info.Size(), 10))
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	_, _ = io.Copy(c.Writer, io.LimitReader(f, info.Size()))
+}
+
+func updateVariables(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	var request struct {
+		Variables map[string]string `json:"variables"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+
+	if err := s.UpdateVariables(request.Variables); err != nil {
+		var verr *templates.ValidationError
+		if errors.As(err, &verr) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":  "The given variables are invalid",
+				"errors": verr.Fields,
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update variables: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"variables": s.Container.Variables,
+	})
+}
+
+func getStartup(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	entrypoint, cmd := s.StartupCmd()
+	c.JSON(http.StatusOK, gin.H{
+		"raw":        s.StartupCommand(),
+		"command":    s.RenderStartup(),
+		"entrypoint": entrypoint,
+		"cmd":        cmd,
+	})
+}
+
+func getInstall(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	c.JSON(http.StatusOK, gin.H{
+		"state":     s.State.String(),
+		"installed": s.Container.Installed,
+		"position":  s.InstallPosition(),
+		"error":     s.Container.InstallError,
+	})
+}
+
+func cancelInstall(c *gin.Context) {
+	s := c.MustGet("server").(*server.Server)
+
+	if err := s.CancelInstall(); err != nil {
+		if errors.Is(err, server.ErrNotInstalling) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Server is not being installed"})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel install: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Install cancelled"})
+}
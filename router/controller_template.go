@@ -1,8 +1,9 @@
 package router
 
 import (
+	"daemon/server"
 	"daemon/templates"
-	"github.com/apex/log"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"strconv"
@@ -29,6 +30,11 @@ func getTemplate(c *gin.Context) {
 
 	t, err := templates.GetTemplate(id)
 	if err != nil {
+		if errors.Is(err, templates.ErrTemplateNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		}
+
 		log.WithError(err).Error("Failed to get template")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get template"})
 		return
@@ -45,11 +51,156 @@ func addTemplate(c *gin.Context) {
 		return
 	}
 
-	if err := templates.AddTemplate(t); err != nil {
-		log.WithError(err).Error("Failed to import template")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import template"})
+	t, err := templates.AddTemplate(t)
+	if err != nil {
+		templateError(c, err, "Failed to create template")
 		return
 	}
 
 	c.JSON(http.StatusOK, t)
 }
+
+func importTemplate(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read egg"})
+		return
+	}
+
+	t, warnings, err := templates.ConvertEgg(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to convert egg: " + err.Error()})
+		return
+	}
+
+	t, err = templates.AddTemplate(t)
+	if err != nil {
+		templateError(c, err, "Failed to import template")
+		return
+	}
+
+	if warnings == nil {
+		warnings = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"template": t,
+		"warnings": warnings,
+	})
+}
+
+func updateTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to convert id"})
+		return
+	}
+
+	var t templates.Template
+	if err := c.ShouldBindJSON(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to bind template"})
+		return
+	}
+
+	t, err = templates.UpdateTemplate(id, t)
+	if err != nil {
+		templateError(c, err, "Failed to update template")
+		return
+	}
+
+	c.JSON(http.StatusOK, t)
+}
+
+func deleteTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to convert id"})
+		return
+	}
+
+	for _, s := range server.Servers {
+		if s.Template == id {
+			c.JSON(http.StatusConflict, gin.H{"error": "Template is used by server " + s.Uuid})
+			return
+		}
+	}
+
+	if err := templates.DeleteTemplate(id); err != nil {
+		templateError(c, err, "Failed to delete template")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template deleted successfully"})
+}
+
+func getTemplateVersions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to convert id"})
+		return
+	}
+
+	versions, err := templates.GetTemplateVersions(id)
+	if err != nil {
+		templateError(c, err, "Failed to get template versions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"versions": versions,
+	})
+}
+
+func getTemplateVersion(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to convert id"})
+		return
+	}
+
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to convert version"})
+		return
+	}
+
+	t, err := templates.GetTemplateVersion(id, version)
+	if err != nil {
+		templateError(c, err, "Failed to get template version")
+		return
+	}
+
+	c.JSON(http.StatusOK, t)
+}
+
+func syncTemplates(c *gin.Context) {
+	result, err := templates.Sync("")
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, templates.ErrNoRepository) {
+			status = http.StatusBadRequest
+		}
+
+		c.JSON(status, gin.H{"error": "Failed to sync templates: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// templateError responds with the status matching an error of the templates
+// package.
+func templateError(c *gin.Context, err error, message string) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, templates.ErrTemplateNotFound), errors.Is(err, templates.ErrVersionNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, templates.ErrTemplateExists), errors.Is(err, templates.ErrVersionConflict):
+		status = http.StatusConflict
+	case errors.Is(err, templates.ErrInvalidTemplate):
+		status = http.StatusBadRequest
+	default:
+		log.WithError(err).Error(message)
+	}
+
+	c.JSON(status, gin.H{"error": message + ": " + err.Error()})
+}
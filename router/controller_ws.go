@@ -6,7 +6,6 @@ import (
 	"daemon/router/websocket"
 	"daemon/server"
 	"encoding/json"
-	"github.com/apex/log"
 	"github.com/gin-gonic/gin"
 )
 
@@ -23,21 +22,49 @@ func getServerWs(c *gin.Context) {
 	}
 
 	defer h.Conn.Close()
+	defer h.StopWatching()
+	defer h.StopConsole()
 
 	log.WithField("server", s.Uuid).Info("web socket connection established")
 	unlisten := events.Listen(h.UUID().String(), func(event events.Event) {
+		if event.Server != s.Uuid {
+			return
+		}
+
 		var e string
 		switch event.Name {
 		case events.ServerLog:
 			e = websocket.ServerLogEvent
 		case events.ServerStats:
 			e = websocket.ServerStatsEvent
+		case events.ServerInstallQueued:
+			e = websocket.ServerInstallQueuedEvent
+		case events.ServerImagePull:
+			e = websocket.ServerImagePullEvent
 		case events.ServerInstallStarted:
 			e = websocket.ServerInstallStartedEvent
 		case events.ServerInstallFinished:
 			e = websocket.ServerInstallFinishedEvent
+		case events.ServerInstallFailed:
+			e = websocket.ServerInstallFailedEvent
+		case events.ServerInstallCancelled:
+			e = websocket.ServerInstallCancelledEvent
 		case events.PowerEvent:
 			e = websocket.ServerPowerEvent
+		case events.ServerFilePull:
+			e = websocket.ServerFilePullEvent
+		case events.ServerBackupProgress:
+			e = websocket.BackupProgressEvent
+		case events.ServerBackupCompleted:
+			e = websocket.BackupCompletedEvent
+		case events.ServerBackupRestoreProgress:
+			e = websocket.RestoreProgressEvent
+		case events.ServerBackupRestoreCompleted:
+			e = websocket.RestoreCompletedEvent
+		case events.ServerScheduleLog:
+			e = websocket.ScheduleLogEvent
+		case events.ServerError:
+			e = websocket.ErrorEvent
 		}
 
 		if e != "" {
@@ -71,12 +98,12 @@ func getServerWs(c *gin.Context) {
 			continue
 		}
 
-		go func(msg websocket.Message) {
+		h.Go("websocket message", func() {
 			if err := h.HandleIncoming(ctx, msg); err != nil {
-				h.SendError()
+				h.SendErrorMessage(err)
 				log.WithError(err).Error("failed to handle incoming message")
 			}
-		}(msg)
+		})
 	}
 }
 
@@ -131,11 +158,11 @@ func getGlobalWs(c *gin.Context) {
 			continue
 		}
 
-		go func(msg websocket.Message) {
+		h.Go("websocket message", func() {
 			if err := h.HandleIncoming(ctx, msg); err != nil {
-				h.SendError()
+				h.SendErrorMessage(err)
 				log.WithError(err).Error("failed to handle incoming message")
 			}
-		}(msg)
+		})
 	}
 }
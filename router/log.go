@@ -0,0 +1,5 @@
+package router
+
+import "daemon/logging"
+
+var log = logging.For("http")
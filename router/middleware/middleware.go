@@ -1,11 +1,51 @@
 package middleware
 
 import (
+	"daemon/logging"
 	"daemon/server"
+	"github.com/apex/log"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"net/http"
+	"time"
 )
 
+// RequestLogger gives every request an ID, returned in the X-Request-Id
+// header, and logs the request with it once it was handled.
+func RequestLogger() gin.HandlerFunc {
+	logger := logging.For("http")
+
+	return func(c *gin.Context) {
+		id := uuid.New().String()
+		c.Header("X-Request-Id", id)
+
+		start := time.Now()
+		c.Next()
+
+		fields := log.Fields{
+			"request_id": id,
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"client":     c.ClientIP(),
+			"latency":    time.Since(start).String(),
+		}
+		if s := c.Param("server"); s != "" {
+			fields["server"] = s
+		}
+
+		entry := logger.WithFields(fields)
+		switch {
+		case len(c.Errors) > 0:
+			entry.WithError(c.Errors.Last()).Warn("request failed")
+		case c.Writer.Status() >= http.StatusInternalServerError:
+			entry.Warn("request failed")
+		default:
+			entry.Debug("request handled")
+		}
+	}
+}
+
 func ServerRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if _, ok := c.Params.Get("server"); !ok {
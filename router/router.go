@@ -2,7 +2,6 @@ package router
 
 import (
 	"daemon/router/middleware"
-	"github.com/apex/log"
 	"github.com/gin-gonic/gin"
 	"net/http"
 )
@@ -13,24 +12,23 @@ func Configure() *gin.Engine {
 	router := gin.New()
 	router.Use(gin.Recovery())
 	router.Use(cors())
+	router.Use(middleware.RequestLogger())
 
 	api := router.Group("/api")
 
-	router.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		log.WithFields(log.Fields{
-			"method":  param.Method,
-			"client":  param.ClientIP,
-			"latency": param.Latency,
-		}).Debugf("[%d] %s %s", param.StatusCode, param.Method, param.Path)
-		return ""
-	}))
-
 	api.GET("/ws", getGlobalWs)
+	api.POST("/backups/gc", collectBackupChunks)
 	template := api.Group("/templates")
 	{
 		template.GET("/", getTemplates)
 		template.GET("/:id", getTemplate)
+		template.GET("/:id/versions", getTemplateVersions)
+		template.GET("/:id/versions/:version", getTemplateVersion)
 		template.POST("/add", addTemplate)
+		template.POST("/import", importTemplate)
+		template.POST("/sync", syncTemplates)
+		template.POST("/:id", updateTemplate)
+		template.DELETE("/:id", deleteTemplate)
 	}
 
 	servers := api.Group("/servers")
@@ -41,10 +39,45 @@ func Configure() *gin.Engine {
 		required.GET("/ws", getServerWs)
 
 		required.GET("/stats", getServerStats)
+		required.GET("/startup", getStartup)
+		required.GET("/install", getInstall)
+		required.GET("/logs", getConsoleLogs)
+		required.GET("/logs/:name", downloadConsoleLog)
 		required.GET("/files", getFiles)
 		required.GET("/files/content", getFileContent)
+		required.GET("/files/search", searchFiles)
+		required.GET("/files/trash", getTrash)
 
+		required.POST("/variables", updateVariables)
 		required.POST("/files", saveFileContent)
+		required.POST("/files/pull", pullRemoteFile)
+		required.POST("/files/trash/:item/restore", restoreTrash)
+
+		required.DELETE("/install", cancelInstall)
+		required.DELETE("/files", deleteFile)
+		required.DELETE("/files/trash", purgeTrash)
+		required.DELETE("/files/trash/:item", purgeTrash)
+
+		backups := required.Group("/backups")
+		{
+			backups.GET("/", getBackups)
+			backups.POST("/", createBackup)
+			backups.GET("/:backup", getBackup)
+			backups.GET("/:backup/download", downloadBackup)
+			backups.POST("/:backup/verify", verifyBackup)
+			backups.POST("/:backup/restore", restoreBackup)
+			backups.DELETE("/:backup", deleteBackup)
+		}
+
+		schedules := required.Group("/schedules")
+		{
+			schedules.GET("/", getSchedules)
+			schedules.POST("/", createSchedule)
+			schedules.GET("/:schedule", getSchedule)
+			schedules.POST("/:schedule", updateSchedule)
+			schedules.POST("/:schedule/run", runSchedule)
+			schedules.DELETE("/:schedule", deleteSchedule)
+		}
 	}
 
 	return router
@@ -55,7 +88,8 @@ func cors() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, If-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusOK)
 			return
@@ -0,0 +1,5 @@
+package websocket
+
+import "daemon/logging"
+
+var log = logging.For("websocket")
@@ -1,23 +1,18 @@
 package websocket
 
 import (
-	"bufio"
 	"context"
-	"daemon/env"
-	"daemon/events"
 	"daemon/server"
-	"daemon/templates"
-	"encoding/json"
-	"github.com/apex/log"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"io"
 	"net/http"
-	"strconv"
+	"path"
+	"runtime/debug"
 	"strings"
 	"sync"
-	"time"
 )
 
 type Handler struct {
@@ -25,17 +20,36 @@ type Handler struct {
 	Conn   *websocket.Conn
 	server *server.Server
 	uuid   uuid.UUID
+
+	watchLock sync.Mutex
+	watches   map[string]func()
+
+	consoleLock sync.Mutex
+	console     *server.ConsoleSubscription
 }
 
 const (
-	ServerLogEvent             = "send console log"
-	ServerCommand              = "send command"
-	ServerStatsEvent           = "send server stats"
-	ServerInstallStartedEvent  = "server install started"
-	ServerInstallFinishedEvent = "server install finished"
-	ServerPowerEvent           = "server power event"
-	ServerCreatedEvent         = "server created"
-	ErrorEvent                 = "error"
+	ServerLogEvent              = "send console log"
+	ServerCommand               = "send command"
+	ServerStatsEvent            = "send server stats"
+	ServerInstallQueuedEvent    = "server install queued"
+	ServerImagePullEvent        = "server image pull"
+	ServerInstallStartedEvent   = "server install started"
+	ServerInstallFinishedEvent  = "server install finished"
+	ServerInstallFailedEvent    = "server install failed"
+	ServerInstallCancelledEvent = "server install cancelled"
+	ServerPowerEvent            = "server power event"
+	ServerCreatedEvent          = "server created"
+	ServerFilePullEvent         = "file pull progress"
+	BackupProgressEvent         = "backup progress"
+	BackupCompletedEvent        = "backup completed"
+	RestoreProgressEvent        = "backup restore progress"
+	RestoreCompletedEvent       = "backup restore completed"
+	SubscribeDirectoryEvent     = "subscribe directory"
+	UnsubscribeDirectoryEvent   = "unsubscribe directory"
+	FileChangesEvent            = "file changes"
+	ScheduleLogEvent            = "schedule log"
+	ErrorEvent                  = "error"
 )
 
 type Message struct {
@@ -55,9 +69,10 @@ func NewHandler(s *server.Server, w http.ResponseWriter, r *http.Request, c *gin
 	}
 
 	return &Handler{
-		Conn:   conn,
-		server: s,
-		uuid:   u,
+		Conn:    conn,
+		server:  s,
+		uuid:    u,
+		watches: map[string]func(){},
 	}, nil
 }
 
@@ -79,13 +94,29 @@ func (h *Handler) Write(data Message) error {
 	return h.Conn.WriteJSON(data)
 }
 
-func (h *Handler) HandleIncoming(ctx context.Context, msg Message) error {
-	d, err := env.GetDocker()
-	if err != nil {
-		log.WithError(err).Error("failed to get docker client")
-		return err
+// Go runs fn in a goroutine of the connection. On a server connection it is
+// supervised by server.Server.Go, otherwise a panic in it is recovered and
+// sent to the client as an error.
+func (h *Handler) Go(name string, fn func()) {
+	if h.server != nil {
+		h.server.Go(name, fn)
+		return
 	}
 
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.WithField("stack", string(debug.Stack())).Errorf("recovered from a panic in %s", name)
+				h.SendErrorMessage(fmt.Errorf("%s failed unexpectedly: %v", name, r))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+func (h *Handler) HandleIncoming(ctx context.Context, msg Message) error {
+	var err error
 	s := h.server
 	switch msg.Event {
 	case ServerStatsEvent:
@@ -112,7 +143,6 @@ func (h *Handler) HandleIncoming(ctx context.Context, msg Message) error {
 
 		if err := s.Command(command); err != nil {
 			log.WithError(err).Error("failed to execute command on server")
-			h.SendError()
 			return err
 		}
 	case ServerPowerEvent:
@@ -138,134 +168,151 @@ func (h *Handler) HandleIncoming(ctx context.Context, msg Message) error {
 
 		if err != nil {
 			log.WithError(err).Error("failed to power on server")
-			h.SendError()
 			return err
 		}
-	case ServerLogEvent:
-		go func() {
-			log.Debugf("starting to listen to logs for server %s", s.Uuid)
-
-			previousLogs, err := s.GetLogsSinceStart()
-			if err != nil {
-				log.WithError(err).Error("failed to get previous logs, is the server running?")
-			}
+	case SubscribeDirectoryEvent:
+		directory, ok := msg.Data.(string)
+		if !ok {
+			log.Error("invalid directory received")
+			h.SendError()
+			return nil
+		}
 
-			payload := map[string]interface{}{
-				"lines":    previousLogs,
-				"daemon":   false,
-				"previous": true,
-			}
-			if err := h.Write(Message{Event: ServerLogEvent, Data: payload}); err != nil {
-				log.WithError(err).Error("failed to send previous logs")
-				return
-			}
+		return h.watchDirectory(directory)
+	case UnsubscribeDirectoryEvent:
+		directory, ok := msg.Data.(string)
+		if !ok {
+			log.Error("invalid directory received")
+			h.SendError()
+			return nil
+		}
 
-			reader, err := s.Logs(true)
-			if err != nil {
-				log.WithError(err).Error("failed to get server logs")
-				h.SendError()
-				return
-			}
-			defer func(reader io.ReadCloser) {
-				err := reader.Close()
-				if err != nil {
-					log.WithError(err).Error("failed to close log reader")
-				}
-			}(reader)
+		h.unwatchDirectory(directory)
+	case ServerLogEvent:
+		h.consoleLock.Lock()
+		defer h.consoleLock.Unlock()
 
-			t, err := templates.GetTemplate(s.Template)
-			if err != nil {
-				log.WithError(err).Error("failed to get server template")
-				h.SendError()
-				return
-			}
+		if h.console != nil {
+			return nil
+		}
 
-			scanner := bufio.NewScanner(reader)
-			for scanner.Scan() {
-				line := scanner.Text()
-				var startConfig struct {
-					Started *string `json:"started"`
-				}
-				if err := json.Unmarshal([]byte(t.Docker.StartConfig), &startConfig); err != nil {
-					log.WithError(err).Error("failed to unmarshal start config")
-					h.SendError()
-					break
-				}
+		log.Debugf("starting to listen to logs for server %s", s.Uuid)
+		previousLogs, sub := s.SubscribeConsole()
+		h.console = sub
 
-				if s.State == server.Starting && startConfig.Started != nil && *startConfig.Started != "" {
-					if strings.Contains(line, *startConfig.Started) {
-						log.Info("server started successfully")
-						s.State = server.Running
-						if err := s.Save(); err != nil {
-							log.WithError(err).Error("failed to save server state after starting")
-						}
-						events.New(events.ServerLog, map[string]interface{}{
-							"daemon":  true,
-							"message": "Server is now running",
-						}).Publish()
-					}
-				}
+		payload := map[string]interface{}{
+			"lines":    previousLogs,
+			"daemon":   false,
+			"previous": true,
+		}
+		if err := h.Write(Message{Event: ServerLogEvent, Data: payload}); err != nil {
+			log.WithError(err).Error("failed to send previous logs")
+			return err
+		}
 
+		h.Go("websocket console", func() {
+			for line := range sub.Lines() {
 				payload := map[string]interface{}{
-					"message": line,
-					"daemon":  false,
+					"message": line.Message,
+					"daemon":  line.Daemon,
 				}
 
 				if err := h.Write(Message{Event: ServerLogEvent, Data: payload}); err != nil {
 					log.WithError(err).Error("failed to send log message")
 				}
 			}
+		})
+	}
 
-			if err := scanner.Err(); err != nil {
-				log.WithError(err).Error("error reading server logs")
-				h.SendError()
-				return
-			}
+	return nil
+}
 
-			if s.State == server.Installing || s.State == server.Stopped {
-				return
-			}
+// StopConsole ends the console subscription of the connection, if there is
+// one.
+func (h *Handler) StopConsole() {
+	h.consoleLock.Lock()
+	defer h.consoleLock.Unlock()
+
+	if h.console != nil {
+		h.console.Close()
+		h.console = nil
+	}
+}
 
-			time.Sleep(500 * time.Millisecond) // wait a bit before sending close message
+// cleanDirectory returns the form of a directory the watches are kept by, so
+// "/plugins/" and "plugins" are the same watch.
+func cleanDirectory(directory string) string {
+	return path.Clean("/" + strings.ReplaceAll(directory, "\\", "/"))
+}
 
-			log.Info("server stopped, closing log stream")
-			events.New(events.PowerEvent, map[string]interface{}{
-				"action": server.PowerStop.String(),
-				"status": server.Stopped.String(),
-			}).Publish()
+func (h *Handler) watchDirectory(directory string) error {
+	if h.server == nil {
+		return errors.New("directories can only be watched on a server connection")
+	}
+	directory = cleanDirectory(directory)
 
-			inspect, err := d.ContainerInspect(ctx, s.DockerId)
-			if err != nil {
-				log.WithError(err).Error("failed to inspect container")
-				return
-			}
+	h.watchLock.Lock()
+	defer h.watchLock.Unlock()
 
-			events.New(events.ServerLog, map[string]interface{}{
-				"daemon":  true,
-				"message": "Server is no longer running",
-			}).Publish()
-
-			if inspect.State.ExitCode != 0 {
-				events.New(events.ServerLog, map[string]interface{}{
-					"daemon":  true,
-					"message": "Server crashed with exit code " + strconv.Itoa(inspect.State.ExitCode),
-				}).Publish()
-				log.WithField("exit_code", inspect.State.ExitCode).Error("server crashed")
-			}
+	if _, ok := h.watches[directory]; ok {
+		return nil
+	}
 
-			s.Stdin.Close()
-			s.State = server.Stopped
-			if err := s.Save(); err != nil {
-				log.WithError(err).Error("failed to save server state after stopping")
-			}
-		}()
+	unwatch, err := h.server.WatchDirectory(directory, func(changes []server.FileChange) {
+		payload := map[string]interface{}{
+			"directory": directory,
+			"changes":   changes,
+		}
+		if err := h.Write(Message{Event: FileChangesEvent, Data: payload}); err != nil {
+			log.WithError(err).Error("failed to send file changes")
+		}
+	})
+	if err != nil {
+		return err
 	}
 
+	h.watches[directory] = unwatch
 	return nil
 }
 
+func (h *Handler) unwatchDirectory(directory string) {
+	directory = cleanDirectory(directory)
+	h.watchLock.Lock()
+	defer h.watchLock.Unlock()
+
+	if unwatch, ok := h.watches[directory]; ok {
+		unwatch()
+		delete(h.watches, directory)
+	}
+}
+
+// StopWatching stops all directory watches of the connection.
+func (h *Handler) StopWatching() {
+	h.watchLock.Lock()
+	defer h.watchLock.Unlock()
+
+	for directory, unwatch := range h.watches {
+		unwatch()
+		delete(h.watches, directory)
+	}
+}
+
 func (h *Handler) SendError() {
 	if err := h.Write(Message{Event: ErrorEvent}); err != nil {
 		log.WithError(err).Error("failed to send error message")
 	}
 }
+
+// SendErrorMessage sends an error event that tells the client what failed.
+func (h *Handler) SendErrorMessage(err error) {
+	payload := map[string]interface{}{
+		"error": err.Error(),
+	}
+	if h.server != nil {
+		payload["server"] = h.server.Uuid
+	}
+
+	if err := h.Write(Message{Event: ErrorEvent, Data: payload}); err != nil {
+		log.WithError(err).Error("failed to send error message")
+	}
+}
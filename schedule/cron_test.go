@@ -0,0 +1,106 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"0 4 * * *", true},
+		{"*/15 * * * *", true},
+		{"5/15 * * * *", true},
+		{"0-30/10 8-17 * * mon-fri", true},
+		{"0 0 1,15 jan,jul *", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{"@HOURLY", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"30-10 * * * *", false},
+		{"* * * foo *", false},
+		{"@reboot", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := ParseCron(tt.expr)
+			if tt.valid && err != nil {
+				t.Fatalf("ParseCron(%q) failed: %v", tt.expr, err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatalf("ParseCron(%q) didn't fail", tt.expr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	// 2024-01-01 is a monday.
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{name: "every minute", expr: "* * * * *", from: "2024-01-01 10:00", want: "2024-01-01 10:01"},
+		{name: "later today", expr: "30 12 * * *", from: "2024-01-01 10:00", want: "2024-01-01 12:30"},
+		{name: "tomorrow", expr: "0 4 * * *", from: "2024-01-01 10:00", want: "2024-01-02 04:00"},
+		{name: "same minute is skipped", expr: "0 10 * * *", from: "2024-01-01 10:00", want: "2024-01-02 10:00"},
+		{name: "step", expr: "*/15 * * * *", from: "2024-01-01 10:16", want: "2024-01-01 10:30"},
+		{name: "step from a start", expr: "5/20 * * * *", from: "2024-01-01 10:26", want: "2024-01-01 10:45"},
+		{name: "range", expr: "0 9-17 * * *", from: "2024-01-01 17:30", want: "2024-01-02 09:00"},
+		{name: "range with a step", expr: "0 8-18/5 * * *", from: "2024-01-01 13:01", want: "2024-01-01 18:00"},
+		{name: "list", expr: "0 0 1,15 * *", from: "2024-01-02 00:00", want: "2024-01-15 00:00"},
+		{name: "month names", expr: "0 0 1 jul *", from: "2024-01-01 10:00", want: "2024-07-01 00:00"},
+		{name: "day of week", expr: "0 0 * * fri", from: "2024-01-01 10:00", want: "2024-01-05 00:00"},
+		{name: "sunday as 7", expr: "0 0 * * 7", from: "2024-01-01 10:00", want: "2024-01-07 00:00"},
+		{name: "weekdays", expr: "0 9 * * mon-fri", from: "2024-01-05 10:00", want: "2024-01-08 09:00"},
+		// when both day fields are restricted either one matching is enough.
+		{name: "day of month or week", expr: "0 0 13 * fri", from: "2024-01-01 10:00", want: "2024-01-05 00:00"},
+		{name: "day of month or week later", expr: "0 0 13 * fri", from: "2024-01-12 10:00", want: "2024-01-13 00:00"},
+		// with one of them "*" only the other one counts.
+		{name: "day of month only", expr: "0 0 13 * *", from: "2024-01-01 10:00", want: "2024-01-13 00:00"},
+		{name: "leap day", expr: "0 0 29 2 *", from: "2024-03-01 00:00", want: "2028-02-29 00:00"},
+		{name: "never", expr: "0 0 31 2 *", from: "2024-01-01 00:00", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := c.Next(at(tt.from))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Fatalf("Next() = %s, want no time", got)
+				}
+				return
+			}
+			if want := at(tt.want); !got.Equal(want) {
+				t.Fatalf("Next() = %s, want %s", got, want)
+			}
+		})
+	}
+}
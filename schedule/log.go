@@ -0,0 +1,5 @@
+package schedule
+
+import "daemon/logging"
+
+var log = logging.For("schedule")
@@ -0,0 +1,507 @@
+package schedule
+
+import (
+	"daemon/backup"
+	"daemon/config"
+	"daemon/events"
+	"daemon/server"
+	"daemon/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ActionCommand = "command"
+	ActionPower   = "power"
+	ActionBackup  = "backup"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrScheduleRunning  = errors.New("schedule is already running")
+
+	mu        sync.Mutex
+	schedules = map[string][]*Schedule{}
+
+	// power runs the power actions of tasks, and powerTimeout is how long a
+	// task waits for one to finish.
+	power        = (*server.Server).Power
+	powerTimeout = 10 * time.Minute
+)
+
+type Schedule struct {
+	Uuid           string `json:"uuid"`
+	Server         string `json:"server"`
+	Name           string `json:"name"`
+	Cron           string `json:"cron"`
+	Enabled        bool   `json:"enabled"`
+	OnlyWhenOnline bool   `json:"only_when_online"`
+	Tasks          []Task `json:"tasks"`
+
+	Running      bool   `json:"running"`
+	LastRunAt    int64  `json:"last_run_at"`
+	LastRunError string `json:"last_run_error"`
+	NextRunAt    int64  `json:"next_run_at"`
+	CreatedAt    int64  `json:"created_at"`
+	UpdatedAt    int64  `json:"updated_at"`
+}
+
+// Task is a step of a schedule. The payload is the command to send, the power
+// action or the adapter to store the backup with, depending on the action.
+type Task struct {
+	Action            string `json:"action"`
+	Payload           string `json:"payload"`
+	Delay             int    `json:"delay"` // seconds to wait before the task
+	ContinueOnFailure bool   `json:"continue_on_failure"`
+}
+
+func directory() string {
+	c := config.Get()
+	return utils.Normalize(c.System.DataDirectory + "/schedules")
+}
+
+func path(server string) string {
+	c := config.Get()
+	return utils.Normalize(c.System.DataDirectory + "/schedules/" + server + ".json")
+}
+
+// Load reads the schedules of all servers and starts running them.
+func Load() {
+	entries, err := os.ReadDir(directory())
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Error("failed to read schedules")
+	}
+
+	mu.Lock()
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(path(strings.TrimSuffix(e.Name(), ".json")))
+		if err != nil {
+			log.WithError(err).Errorf("failed to read schedules %s", e.Name())
+			continue
+		}
+
+		var list []*Schedule
+		if err := json.Unmarshal(data, &list); err != nil {
+			log.WithError(err).Errorf("failed to load schedules %s", e.Name())
+			continue
+		}
+
+		for _, sc := range list {
+			sc.Running = false
+			sc.updateNextRun(time.Now())
+			schedules[sc.Server] = append(schedules[sc.Server], sc)
+		}
+	}
+	mu.Unlock()
+
+	events.Listen("schedules", onEvent)
+
+	go loop()
+}
+
+// loop runs the due schedules at the start of every minute.
+func loop() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		now = time.Now()
+		mu.Lock()
+		var due []*Schedule
+		for _, list := range schedules {
+			for _, sc := range list {
+				if sc.Enabled && !sc.Running && sc.NextRunAt != 0 && sc.NextRunAt <= now.Unix() {
+					due = append(due, sc)
+				}
+			}
+		}
+		mu.Unlock()
+
+		for _, sc := range due {
+			if err := sc.trigger(false); err != nil && !errors.Is(err, ErrScheduleRunning) {
+				log.WithError(err).WithField("schedule", sc.Uuid).Error("failed to run schedule")
+			}
+		}
+	}
+}
+
+// save writes the schedules of a server to disk. mu must be held.
+func save(server string) error {
+	if err := os.MkdirAll(directory(), 0755); err != nil {
+		return err
+	}
+
+	list := schedules[server]
+	if list == nil {
+		list = []*Schedule{}
+	}
+
+	data, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path(server), data, 0644)
+}
+
+func (sc *Schedule) validate() error {
+	if strings.TrimSpace(sc.Name) == "" {
+		return errors.New("schedule name is required")
+	}
+
+	if _, err := ParseCron(sc.Cron); err != nil {
+		return err
+	}
+
+	if len(sc.Tasks) == 0 {
+		return errors.New("schedule must have at least one task")
+	}
+
+	for i, t := range sc.Tasks {
+		if t.Delay < 0 {
+			return fmt.Errorf("task %d has a negative delay", i+1)
+		}
+
+		switch t.Action {
+		case ActionCommand:
+			if strings.TrimSpace(t.Payload) == "" {
+				return fmt.Errorf("task %d has no command", i+1)
+			}
+		case ActionPower:
+			if _, err := powerAction(t.Payload); err != nil {
+				return fmt.Errorf("task %d: %s", i+1, err.Error())
+			}
+		case ActionBackup:
+		default:
+			return fmt.Errorf("task %d has an unknown action %q", i+1, t.Action)
+		}
+	}
+
+	return nil
+}
+
+// onEvent drops the schedules of deleted servers.
+func onEvent(e events.Event) {
+	if e.Name == events.ServerDeleted {
+		mu.Lock()
+		forget(e.Server)
+		mu.Unlock()
+	}
+}
+
+// forget removes the schedules of a server that no longer exists. mu must be
+// held.
+func forget(server string) {
+	delete(schedules, server)
+	if err := os.Remove(path(server)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("server", server).Error("failed to remove schedules")
+	}
+}
+
+// updateNextRun sets the next time the schedule is due after t. mu must be
+// held.
+func (sc *Schedule) updateNextRun(t time.Time) {
+	sc.NextRunAt = 0
+	if !sc.Enabled {
+		return
+	}
+
+	c, err := ParseCron(sc.Cron)
+	if err != nil {
+		return
+	}
+
+	if next := c.Next(t); !next.IsZero() {
+		sc.NextRunAt = next.Unix()
+	}
+}
+
+// List returns the schedules of the server.
+func List(s *server.Server) []Schedule {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := []Schedule{}
+	for _, sc := range schedules[s.Uuid] {
+		list = append(list, *sc)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt < list[j].CreatedAt
+	})
+
+	return list
+}
+
+// Get returns a schedule of the server by its UUID.
+func Get(s *server.Server, id string) (*Schedule, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	sc := find(s.Uuid, id)
+	if sc == nil {
+		return nil, ErrScheduleNotFound
+	}
+
+	copied := *sc
+	return &copied, nil
+}
+
+// find returns the stored schedule. mu must be held.
+func find(server string, id string) *Schedule {
+	for _, sc := range schedules[server] {
+		if sc.Uuid == id {
+			return sc
+		}
+	}
+
+	return nil
+}
+
+// Create adds a schedule to the server. Only the name, cron expression,
+// options and tasks of sc are used.
+func Create(s *server.Server, sc Schedule) (*Schedule, error) {
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	created := &Schedule{
+		Uuid:           uuid.New().String(),
+		Server:         s.Uuid,
+		Name:           sc.Name,
+		Cron:           sc.Cron,
+		Enabled:        sc.Enabled,
+		OnlyWhenOnline: sc.OnlyWhenOnline,
+		Tasks:          sc.Tasks,
+		CreatedAt:      now.Unix(),
+		UpdatedAt:      now.Unix(),
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	created.updateNextRun(now)
+	schedules[s.Uuid] = append(schedules[s.Uuid], created)
+	if err := save(s.Uuid); err != nil {
+		schedules[s.Uuid] = schedules[s.Uuid][:len(schedules[s.Uuid])-1]
+		return nil, err
+	}
+
+	copied := *created
+	return &copied, nil
+}
+
+// Update replaces the name, cron expression, options and tasks of a schedule
+// with the ones of sc.
+func Update(s *server.Server, id string, sc Schedule) (*Schedule, error) {
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	existing := find(s.Uuid, id)
+	if existing == nil {
+		return nil, ErrScheduleNotFound
+	}
+
+	existing.Name = sc.Name
+	existing.Cron = sc.Cron
+	existing.Enabled = sc.Enabled
+	existing.OnlyWhenOnline = sc.OnlyWhenOnline
+	existing.Tasks = sc.Tasks
+	existing.UpdatedAt = time.Now().Unix()
+	existing.updateNextRun(time.Now())
+	if err := save(s.Uuid); err != nil {
+		return nil, err
+	}
+
+	copied := *existing
+	return &copied, nil
+}
+
+// Delete removes a schedule of the server. A run that is in progress is
+// finished.
+func Delete(s *server.Server, id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := schedules[s.Uuid]
+	for i, sc := range list {
+		if sc.Uuid == id {
+			schedules[s.Uuid] = append(list[:i:i], list[i+1:]...)
+			return save(s.Uuid)
+		}
+	}
+
+	return ErrScheduleNotFound
+}
+
+// Run starts running a schedule of the server right away, whether it is
+// enabled or not.
+func Run(s *server.Server, id string) error {
+	mu.Lock()
+	sc := find(s.Uuid, id)
+	mu.Unlock()
+
+	if sc == nil {
+		return ErrScheduleNotFound
+	}
+
+	return sc.trigger(true)
+}
+
+// trigger marks the schedule as running and runs its tasks in the
+// background.
+func (sc *Schedule) trigger(manual bool) error {
+	mu.Lock()
+	if sc.Running {
+		mu.Unlock()
+		return ErrScheduleRunning
+	}
+
+	s, err := server.GetServer(sc.Server)
+	if err != nil {
+		// the server was deleted while the daemon wasn't listening.
+		forget(sc.Server)
+		mu.Unlock()
+		return err
+	}
+
+	sc.Running = true
+	sc.LastRunAt = time.Now().Unix()
+	sc.updateNextRun(time.Now())
+	mu.Unlock()
+
+	s.Go("schedule", func() {
+		err := sc.run(s, manual)
+
+		mu.Lock()
+		sc.Running = false
+		sc.LastRunError = ""
+		if err != nil {
+			sc.LastRunError = err.Error()
+		}
+		if err := save(sc.Server); err != nil {
+			log.WithError(err).WithField("server", sc.Server).Error("failed to save schedules")
+		}
+		mu.Unlock()
+
+		sc.publish(-1, "Schedule finished", err)
+	})
+
+	return nil
+}
+
+func (sc *Schedule) run(s *server.Server, manual bool) error {
+	if sc.OnlyWhenOnline && !manual && s.State != server.Running {
+		sc.publish(-1, "Skipping schedule as the server is not online", nil)
+		return nil
+	}
+
+	sc.publish(-1, "Running schedule", nil)
+
+	mu.Lock()
+	tasks := append([]Task{}, sc.Tasks...)
+	mu.Unlock()
+
+	var failed error
+	for i, t := range tasks {
+		if t.Delay > 0 {
+			time.Sleep(time.Duration(t.Delay) * time.Second)
+		}
+
+		err := runTask(s, t)
+		sc.publish(i, "Ran "+t.Action+" task", err)
+		if err != nil {
+			failed = fmt.Errorf("task %d: %w", i+1, err)
+			if !t.ContinueOnFailure {
+				return failed
+			}
+		}
+	}
+
+	return failed
+}
+
+func runTask(s *server.Server, t Task) error {
+	switch t.Action {
+	case ActionCommand:
+		if s.State != server.Running || s.Stdin.Conn == nil {
+			return errors.New("server is not running")
+		}
+
+		return s.Command(t.Payload)
+	case ActionPower:
+		action, err := powerAction(t.Payload)
+		if err != nil {
+			return err
+		}
+
+		// a power action that hangs would keep the schedule running forever.
+		done, fn := make(chan error, 1), power
+		s.Go("schedule power action", func() {
+			done <- fn(s, action)
+		})
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(powerTimeout):
+			return fmt.Errorf("power action %s didn't finish within %s", action, powerTimeout)
+		}
+	case ActionBackup:
+		// the next tasks, like a restart, must wait for the backup.
+		_, err := backup.CreateAndWait(s, nil, t.Payload)
+		return err
+	}
+
+	return errors.New("unknown action " + t.Action)
+}
+
+func powerAction(name string) (server.PowerAction, error) {
+	for _, a := range []server.PowerAction{server.PowerStart, server.PowerStop, server.PowerRestart, server.PowerKill} {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+
+	return 0, errors.New("unknown power action " + name)
+}
+
+// publish sends a line of the execution log of the schedule. task is the
+// index of the task it is about, or -1 for the schedule itself.
+func (sc *Schedule) publish(task int, message string, err error) {
+	// the name can be changed by Update while the schedule runs.
+	mu.Lock()
+	name := sc.Name
+	mu.Unlock()
+
+	payload := map[string]interface{}{
+		"server":     sc.Server,
+		"schedule":   sc.Uuid,
+		"name":       name,
+		"task":       task,
+		"message":    message,
+		"successful": err == nil,
+		"time":       time.Now().Unix(),
+	}
+	if err != nil {
+		payload["error"] = err.Error()
+	}
+
+	events.ForServer(sc.Server, events.ServerScheduleLog, payload).Publish()
+}
@@ -0,0 +1,171 @@
+package schedule
+
+import (
+	"daemon/config"
+	"daemon/events"
+	"daemon/server"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	dir := t.TempDir()
+	c := config.DefaultConfig(filepath.Join(dir, "config.yml"))
+	c.System.DataDirectory = filepath.Join(dir, "data")
+	c.System.VolumesDirectory = filepath.Join(dir, "volumes")
+	config.Set(c)
+
+	if err := os.MkdirAll(directory(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server.Server{Id: "00000000", Uuid: "00000000-0000-0000-0000-000000000000", State: server.Running}
+	server.Servers = append(server.Servers, s)
+	t.Cleanup(func() {
+		server.Servers = nil
+		mu.Lock()
+		delete(schedules, s.Uuid)
+		mu.Unlock()
+	})
+
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	task := func(action, payload string) []Task {
+		return []Task{{Action: action, Payload: payload}}
+	}
+
+	tests := []struct {
+		name  string
+		sc    Schedule
+		error string
+	}{
+		{name: "valid", sc: Schedule{Name: "restart", Cron: "0 4 * * *", Tasks: task(ActionPower, "restart")}},
+		{name: "backup", sc: Schedule{Name: "backup", Cron: "@daily", Tasks: task(ActionBackup, "")}},
+		{name: "no name", sc: Schedule{Name: " ", Cron: "0 4 * * *", Tasks: task(ActionPower, "restart")}, error: "name is required"},
+		{name: "bad cron", sc: Schedule{Name: "x", Cron: "0 25 * * *", Tasks: task(ActionPower, "restart")}, error: "out of range"},
+		{name: "no tasks", sc: Schedule{Name: "x", Cron: "0 4 * * *"}, error: "at least one task"},
+		{name: "negative delay", sc: Schedule{Name: "x", Cron: "0 4 * * *", Tasks: []Task{{Action: ActionBackup, Delay: -1}}}, error: "negative delay"},
+		{name: "no command", sc: Schedule{Name: "x", Cron: "0 4 * * *", Tasks: task(ActionCommand, "  ")}, error: "no command"},
+		{name: "bad power action", sc: Schedule{Name: "x", Cron: "0 4 * * *", Tasks: task(ActionPower, "reboot")}, error: "task 1"},
+		{name: "unknown action", sc: Schedule{Name: "x", Cron: "0 4 * * *", Tasks: task("delete", "")}, error: "unknown action"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sc.validate()
+			if tt.error == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v, want no error", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Fatalf("validate() = %v, want an error containing %q", err, tt.error)
+			}
+		})
+	}
+}
+
+func TestPowerTaskTimesOut(t *testing.T) {
+	s := newTestServer(t)
+
+	release := make(chan struct{})
+	defer close(release)
+	power, powerTimeout = func(*server.Server, server.PowerAction) error {
+		<-release
+		return nil
+	}, 50*time.Millisecond
+	defer func() {
+		power, powerTimeout = (*server.Server).Power, 10*time.Minute
+	}()
+
+	sc, err := Create(s, Schedule{Name: "restart", Cron: "0 4 * * *", Tasks: []Task{{Action: ActionPower, Payload: "restart"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(s, sc.Uuid); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+
+	if got := waitForRun(t, s, sc.Uuid); !strings.Contains(got.LastRunError, "didn't finish") {
+		t.Fatalf("LastRunError = %q, want the timeout", got.LastRunError)
+	}
+
+	if err := Run(s, sc.Uuid); err != nil {
+		t.Fatalf("Run() after a timeout = %v, want the schedule to run again", err)
+	}
+	waitForRun(t, s, sc.Uuid)
+}
+
+// waitForRun waits for a run of the schedule to finish.
+func waitForRun(t *testing.T, s *server.Server, id string) *Schedule {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sc, err := Get(s, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sc.Running {
+			return sc
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the schedule is still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSchedulesOfDeletedServerAreRemoved(t *testing.T) {
+	s := newTestServer(t)
+
+	if _, err := Create(s, Schedule{Name: "backup", Cron: "@daily", Tasks: []Task{{Action: ActionBackup}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path(s.Uuid)); err != nil {
+		t.Fatal(err)
+	}
+
+	onEvent(events.ForServer(s.Uuid, events.ServerDeleted, s.Id))
+
+	if list := List(s); len(list) != 0 {
+		t.Fatalf("the deleted server still has %d schedules", len(list))
+	}
+	if _, err := os.Stat(path(s.Uuid)); !os.IsNotExist(err) {
+		t.Fatalf("the schedules file of the deleted server wasn't removed: %v", err)
+	}
+}
+
+func TestTriggerForgetsMissingServer(t *testing.T) {
+	s := newTestServer(t)
+
+	sc, err := Create(s, Schedule{Name: "backup", Cron: "@daily", Tasks: []Task{{Action: ActionBackup}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is gone without its deletion having been seen.
+	server.Servers = nil
+	mu.Lock()
+	stored := find(s.Uuid, sc.Uuid)
+	mu.Unlock()
+	if err := stored.trigger(false); err == nil {
+		t.Fatal("trigger() of a schedule of a missing server didn't fail")
+	}
+
+	if list := List(s); len(list) != 0 {
+		t.Fatalf("the missing server still has %d schedules", len(list))
+	}
+	if _, err := os.Stat(path(s.Uuid)); !os.IsNotExist(err) {
+		t.Fatalf("the schedules file of the missing server wasn't removed: %v", err)
+	}
+}
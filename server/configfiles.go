@@ -0,0 +1,130 @@
+package server
+
+import (
+	"daemon/config"
+	"daemon/parser"
+	"daemon/templates"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// configPlaceholder matches the {{server.build.default.port}} style of
+// placeholders as well as the shorter {$PORT} one.
+var configPlaceholder = regexp.MustCompile(`{{\s*([A-Za-z0-9_.]+)\s*}}|{\$([A-Za-z0-9_]+)}`)
+
+// configValue returns the value of a placeholder of a config file.
+func (s *Server) configValue(name string, vars map[string]string) (string, bool) {
+	switch name {
+	case "server.build.default.ip", "IP":
+		return vars["SERVER_IP"], true
+	case "server.build.default.port", "PORT":
+		return vars["SERVER_PORT"], true
+	case "server.build.memory":
+		return vars["SERVER_MEMORY"], true
+	case "server.build.disk":
+		return vars["SERVER_DISK"], true
+	case "server.build.cpu":
+		return vars["SERVER_CPU"], true
+	case "server.uuid", "UUID":
+		return s.Uuid, true
+	case "server.name", "NAME":
+		return s.Name, true
+	case "config.docker.interface":
+		return config.Get().Docker.Network.Interface, true
+	}
+
+	name = strings.TrimPrefix(name, "server.build.env.")
+	name = strings.TrimPrefix(name, "env.")
+	v, ok := vars[name]
+	return v, ok
+}
+
+// renderConfigValue replaces the placeholders in a value of a config file.
+// Placeholders without a value are left as they are.
+func (s *Server) renderConfigValue(value string, vars map[string]string) string {
+	return configPlaceholder.ReplaceAllStringFunc(value, func(match string) string {
+		m := configPlaceholder.FindStringSubmatch(match)
+		name := m[1]
+		if name == "" {
+			name = m[2]
+		}
+
+		if v, ok := s.configValue(name, vars); ok {
+			return v
+		}
+
+		return match
+	})
+}
+
+// applyConfigFiles patches the config files of the template in the server
+// volume. A file that fails is reported and skipped, so it doesn't keep the
+// server from starting.
+func (s *Server) applyConfigFiles(t templates.Template) {
+	vars := s.StartupVariables()
+
+	for _, f := range t.Docker.ConfigFiles {
+		if err := s.applyConfigFile(f, vars); err != nil {
+			s.ReportError(fmt.Errorf("failed to apply config file %s: %w", f.Path, err))
+		}
+	}
+}
+
+func (s *Server) applyConfigFile(f templates.ConfigFile, vars map[string]string) error {
+	p, err := s.resolvePath(f.Path)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	info, err := os.Lstat(p)
+	if err == nil {
+		if !info.Mode().IsRegular() {
+			return errors.New("config file is not a regular file")
+		}
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var data []byte
+	if info != nil {
+		if data, err = os.ReadFile(p); err != nil {
+			return err
+		}
+	} else if f.Content != "" {
+		data = []byte(s.renderConfigValue(f.Content, vars))
+	} else if len(f.Replace) == 0 || f.Parser == "" || f.Parser == "file" {
+		// the keys of a missing file are added, but lines can't be.
+		return nil
+	}
+
+	replacements := make([]parser.Replacement, len(f.Replace))
+	for i, r := range f.Replace {
+		replacements[i] = parser.Replacement{
+			Match:       r.Match,
+			IfValue:     s.renderConfigValue(r.IfValue, vars),
+			ReplaceWith: s.renderConfigValue(r.ReplaceWith, vars),
+		}
+	}
+
+	out, err := parser.Parse(f.Parser, data, replacements)
+	if err != nil {
+		return err
+	}
+
+	if info != nil && string(out) == string(data) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	log.WithField("server", s.Uuid).Debugf("writing config file %s (%d bytes)", f.Path, len(out))
+	return os.WriteFile(p, out, mode)
+}
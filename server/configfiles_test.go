@@ -0,0 +1,134 @@
+package server
+
+import (
+	"daemon/parser"
+	"daemon/templates"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderConfigValue(t *testing.T) {
+	s := &Server{Uuid: "uuid", Name: "name"}
+	vars := map[string]string{"SERVER_IP": "0.0.0.0", "SERVER_PORT": "25565", "SERVER_MEMORY": "1024", "MOTD": "hi"}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "{{server.build.default.port}}", want: "25565"},
+		{value: "{{ server.build.default.ip }}:{$PORT}", want: "0.0.0.0:25565"},
+		{value: "{{server.build.memory}}M", want: "1024M"},
+		{value: "{{server.uuid}} {$NAME}", want: "uuid name"},
+		{value: "{{server.build.env.MOTD}} {{env.MOTD}} {$MOTD}", want: "hi hi hi"},
+		{value: "{{env.MISSING}} {$MISSING}", want: "{{env.MISSING}} {$MISSING}"},
+		{value: "plain", want: "plain"},
+	}
+
+	for _, tt := range tests {
+		if got := s.renderConfigValue(tt.value, vars); got != tt.want {
+			t.Errorf("renderConfigValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	vars := map[string]string{"SERVER_PORT": "25566"}
+
+	tests := []struct {
+		name     string
+		existing string
+		file     templates.ConfigFile
+		// want is the content of the file afterwards, with "" for no file.
+		want string
+	}{
+		{
+			name:     "existing file",
+			existing: "server-port=25565\r\nmotd=x\r\n",
+			file: templates.ConfigFile{
+				Parser:  "properties",
+				Content: "ignored=true\n",
+				Replace: []parser.Replacement{{Match: "server-port", ReplaceWith: "{{server.build.default.port}}"}},
+			},
+			want: "server-port=25566\r\nmotd=x\r\n",
+		},
+		{
+			name: "missing file with content",
+			file: templates.ConfigFile{
+				Parser:  "yaml",
+				Content: "port: {$PORT}\nhost: x\n",
+				Replace: []parser.Replacement{{Match: "host", ReplaceWith: "y"}},
+			},
+			want: "port: 25566\nhost: y\n",
+		},
+		{
+			name: "missing file without content",
+			file: templates.ConfigFile{
+				Parser:  "json",
+				Replace: []parser.Replacement{{Match: "server.port", ReplaceWith: "{$PORT}"}},
+			},
+			want: "{\n  \"server\": {\n    \"port\": 25566\n  }\n}\n",
+		},
+		{
+			name: "missing file of lines",
+			file: templates.ConfigFile{
+				Parser:  "file",
+				Replace: []parser.Replacement{{Match: "port", ReplaceWith: "port {$PORT}"}},
+			},
+			want: "",
+		},
+		{
+			name:     "if value",
+			existing: "[a]\npvp=false\nport=1\n",
+			file: templates.ConfigFile{
+				Parser: "ini",
+				Replace: []parser.Replacement{
+					{Match: "a.pvp", IfValue: "true", ReplaceWith: "false"},
+					{Match: "a.port", IfValue: "1", ReplaceWith: "{$PORT}"},
+				},
+			},
+			want: "[a]\npvp=false\nport=25566\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			tt.file.Path = "config/server.cfg"
+			p := filepath.Join(s.VolumePath(), "config", "server.cfg")
+
+			if tt.existing != "" {
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(tt.existing), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := s.applyConfigFile(tt.file, vars); err != nil {
+				t.Fatalf("applyConfigFile() failed: %v", err)
+			}
+
+			b, err := os.ReadFile(p)
+			if tt.want == "" {
+				if !os.IsNotExist(err) {
+					t.Fatalf("a file was created: %q, %v", b, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Fatalf("the file is\n%q\nwant\n%q", b, tt.want)
+			}
+
+			if tt.existing != "" {
+				if info, err := os.Stat(p); err != nil || info.Mode().Perm() != 0600 {
+					t.Fatalf("the mode of the file wasn't kept: %v, %v", info.Mode(), err)
+				}
+			}
+		})
+	}
+}
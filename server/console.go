@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"daemon/config"
+	"daemon/env"
+	"daemon/events"
+	"daemon/templates"
+	"daemon/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/container"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriberBuffer is the amount of lines queued for a console subscriber
+	// before further lines are dropped for it.
+	subscriberBuffer = 512
+
+	// minConsoleRetry and maxConsoleRetry bound the wait before the log
+	// stream is opened again after it failed or ended without output.
+	minConsoleRetry = time.Second
+	maxConsoleRetry = 30 * time.Second
+)
+
+var (
+	ErrConsoleLogNotFound = errors.New("console log not found")
+
+	consolesMu sync.Mutex
+	consoles   = map[string]*console{}
+)
+
+// ConsoleLog is a console log file of a server, either the current one or
+// one that was rotated.
+type ConsoleLog struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Compressed bool   `json:"compressed"`
+	ModifiedAt int64  `json:"modified_at"`
+}
+
+// ConsoleLine is a line sent to console subscribers. Daemon lines are notices
+// of the daemon rather than output of the server.
+type ConsoleLine struct {
+	Message string
+	Daemon  bool
+}
+
+// console is the pipeline of a server console: a single stream of the
+// container output that is kept in a ring buffer, written to the console log
+// files and fanned out to every subscriber.
+type console struct {
+	mu          sync.Mutex
+	following   bool
+	lines       []string
+	next        int
+	full        bool
+	subscribers map[*ConsoleSubscription]struct{}
+}
+
+// ConsoleSubscription receives the console lines of a server until it is
+// closed.
+type ConsoleSubscription struct {
+	console *console
+	lines   chan ConsoleLine
+	dropped int
+	closed  bool
+}
+
+func getConsole(s *Server) *console {
+	consolesMu.Lock()
+	defer consolesMu.Unlock()
+
+	c, ok := consoles[s.Uuid]
+	if !ok {
+		size := config.Get().Console.Scrollback
+		if size <= 0 {
+			size = 1
+		}
+
+		c = &console{
+			lines:       make([]string, size),
+			subscribers: map[*ConsoleSubscription]struct{}{},
+		}
+		consoles[s.Uuid] = c
+	}
+
+	return c
+}
+
+// scrollback returns the buffered lines, oldest first. c.mu must be held.
+func (c *console) scrollback() []string {
+	if !c.full {
+		return append([]string{}, c.lines[:c.next]...)
+	}
+
+	return append(append([]string{}, c.lines[c.next:]...), c.lines[:c.next]...)
+}
+
+// push adds a line of output to the buffer and sends it to the subscribers.
+func (c *console) push(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lines[c.next] = line
+	c.next++
+	if c.next == len(c.lines) {
+		c.next = 0
+		c.full = true
+	}
+
+	for sub := range c.subscribers {
+		sub.send(ConsoleLine{Message: line})
+	}
+}
+
+// notice sends a daemon message to the subscribers.
+func (c *console) notice(message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for sub := range c.subscribers {
+		sub.send(ConsoleLine{Message: message, Daemon: true})
+	}
+}
+
+// send queues a line without blocking the pipeline. Lines that do not fit
+// are dropped for this subscriber only, and it is told how many once it has
+// room again. c.mu must be held.
+func (sub *ConsoleSubscription) send(line ConsoleLine) {
+	if sub.dropped > 0 {
+		select {
+		case sub.lines <- ConsoleLine{Message: strconv.Itoa(sub.dropped) + " console lines were dropped as the connection could not keep up", Daemon: true}:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+			return
+		}
+	}
+
+	select {
+	case sub.lines <- line:
+	default:
+		sub.dropped++
+	}
+}
+
+// SubscribeConsole returns the console lines in the scrollback buffer of the
+// server, and a subscription that receives every line after them.
+func (s *Server) SubscribeConsole() ([]string, *ConsoleSubscription) {
+	c := getConsole(s)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sub := &ConsoleSubscription{
+		console: c,
+		lines:   make(chan ConsoleLine, subscriberBuffer),
+	}
+	c.subscribers[sub] = struct{}{}
+
+	return c.scrollback(), sub
+}
+
+// Lines returns the channel the lines are received on. It is closed when the
+// subscription is.
+func (sub *ConsoleSubscription) Lines() <-chan ConsoleLine {
+	return sub.lines
+}
+
+func (sub *ConsoleSubscription) Close() {
+	sub.console.mu.Lock()
+	defer sub.console.mu.Unlock()
+
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+
+	delete(sub.console.subscribers, sub)
+	close(sub.lines)
+}
+
+func (s *Server) consoleLogDir() string {
+	c := config.Get()
+	return utils.Normalize(c.System.LogDirectory + "/servers/" + s.Uuid)
+}
+
+// followConsole starts the console pipeline of the server with the container
+// output from since on, until the container stops. Nothing happens when the
+// pipeline is already running.
+func (s *Server) followConsole(since time.Time) {
+	if s.DockerId == "" {
+		return
+	}
+
+	c := getConsole(s)
+	c.mu.Lock()
+	if c.following {
+		c.mu.Unlock()
+		return
+	}
+	c.following = true
+	c.mu.Unlock()
+
+	s.Go("console", func() {
+		defer func() {
+			c.mu.Lock()
+			c.following = false
+			c.mu.Unlock()
+		}()
+
+		var w *utils.RotatingWriter
+		if conf := config.Get().Console; conf.Persist {
+			var err error
+			w, err = utils.NewRotatingWriter(s.consoleLogDir(), "console", utils.RotateOptions{
+				MaxSize:   conf.MaxSize,
+				MaxAge:    time.Duration(conf.MaxAge) * time.Hour,
+				Compress:  conf.Compress,
+				MaxFiles:  conf.MaxFiles,
+				Retention: time.Duration(conf.Retention) * time.Hour,
+			})
+			if err != nil {
+				log.WithError(err).WithField("server", s.Uuid).Error("failed to open console log")
+			} else {
+				defer w.Close()
+			}
+		}
+
+		// the log stream ends when the container stops, which also happens
+		// for a moment while it is restarted.
+		t := newThrottle(config.Get().Console.Throttle)
+		retry := minConsoleRetry
+		for {
+			last, err := s.copyConsole(c, w, t, since)
+			if err != nil {
+				log.WithError(err).WithField("server", s.Uuid).Warn("console log stream ended")
+			}
+
+			if notice := t.summary(); notice != "" {
+				s.consoleNotice(c, w, notice)
+			}
+
+			if GetState(s.DockerId) != Running {
+				s.consoleEnded()
+				return
+			}
+
+			// a stream that keeps failing or ending right away must not be
+			// reopened in a busy loop.
+			if err != nil || !last.After(since) {
+				time.Sleep(retry)
+				retry = nextConsoleRetry(retry)
+			} else {
+				retry = minConsoleRetry
+			}
+			since = last
+		}
+	})
+}
+
+// copyConsole reads the lines of the container output since the given time
+// into the pipeline, and writes them to w prefixed with the time they were
+// read at if it is set. Lines over the limits of t are dropped. It returns
+// when the output ends, with the time of the last line.
+func (s *Server) copyConsole(c *console, w *utils.RotatingWriter, t *throttle, since time.Time) (time.Time, error) {
+	cli, err := env.GetDocker()
+	if err != nil {
+		return since, err
+	}
+
+	reader, err := cli.ContainerLogs(context.Background(), s.DockerId, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Since:      fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+	})
+	if err != nil {
+		return since, err
+	}
+	defer reader.Close()
+
+	started := s.startedMessage()
+	last := since
+	r := bufio.NewReader(reader)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			last = time.Now()
+			line = strings.TrimRight(line, "\r\n")
+
+			if started != "" && s.State == Starting && strings.Contains(line, started) {
+				s.markRunning()
+			}
+
+			allowed, notices, stop := t.allow(line, last)
+			for _, notice := range notices {
+				s.consoleNotice(c, w, notice)
+			}
+
+			if stop {
+				s.consoleNotice(c, w, "Stopping server as it keeps exceeding the console output limits")
+				s.Go("console throttle", func() {
+					if err := s.Power(PowerStop); err != nil {
+						s.ReportError(fmt.Errorf("failed to stop server flooding its console: %w", err))
+					}
+				})
+			}
+
+			if allowed {
+				c.push(line)
+				writeConsoleLog(w, last, line)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return last, nil
+		} else if err != nil {
+			return last, err
+		}
+	}
+}
+
+// nextConsoleRetry doubles the wait before the log stream is reopened, up to
+// maxConsoleRetry.
+func nextConsoleRetry(retry time.Duration) time.Duration {
+	if retry *= 2; retry > maxConsoleRetry {
+		return maxConsoleRetry
+	}
+
+	return retry
+}
+
+// consoleNotice sends a daemon message to the console subscribers and the
+// console log.
+func (s *Server) consoleNotice(c *console, w *utils.RotatingWriter, message string) {
+	c.notice(message)
+	writeConsoleLog(w, time.Now(), "[daemon] "+message)
+}
+
+func writeConsoleLog(w *utils.RotatingWriter, t time.Time, line string) {
+	if w == nil {
+		return
+	}
+
+	if _, err := w.Write([]byte("[" + t.Format(time.RFC3339) + "] " + line + "\n")); err != nil {
+		log.WithError(err).Error("failed to write console log")
+	}
+}
+
+// startedMessage returns the output line of the template that marks the
+// server as running, if it has one.
+func (s *Server) startedMessage() string {
+	t, err := templates.GetTemplate(s.Template)
+	if err != nil {
+		return ""
+	}
+
+	var conf struct {
+		Started *string `json:"started"`
+	}
+	if err := json.Unmarshal([]byte(t.Docker.StartConfig), &conf); err != nil || conf.Started == nil {
+		return ""
+	}
+
+	return *conf.Started
+}
+
+func (s *Server) markRunning() {
+	log.WithField("server", s.Uuid).Info("server started successfully")
+	s.State = Running
+	if err := s.Save(); err != nil {
+		log.WithError(err).Error("failed to save server state after starting")
+	}
+
+	events.ForServer(s.Uuid, events.PowerEvent, map[string]interface{}{
+		"action": PowerStart.String(),
+		"status": Running.String(),
+	}).Publish()
+	events.ForServer(s.Uuid, events.ServerLog, map[string]interface{}{
+		"daemon":  true,
+		"message": "Server is now running",
+	}).Publish()
+}
+
+// consoleEnded updates the state of the server once its container stopped,
+// reporting a crash if it exited with an error.
+func (s *Server) consoleEnded() {
+	if s.State == Installing || s.State == Queued || s.State == Stopped {
+		return
+	}
+
+	log.WithField("server", s.Uuid).Info("server stopped, closing console")
+	events.ForServer(s.Uuid, events.PowerEvent, map[string]interface{}{
+		"action": PowerStop.String(),
+		"status": Stopped.String(),
+	}).Publish()
+
+	events.ForServer(s.Uuid, events.ServerLog, map[string]interface{}{
+		"daemon":  true,
+		"message": "Server is no longer running",
+	}).Publish()
+
+	cli, err := env.GetDocker()
+	if err == nil {
+		inspect, err := cli.ContainerInspect(context.Background(), s.DockerId)
+		if err != nil {
+			log.WithError(err).Error("failed to inspect container")
+		} else if inspect.State.ExitCode != 0 {
+			events.ForServer(s.Uuid, events.ServerLog, map[string]interface{}{
+				"daemon":  true,
+				"message": "Server crashed with exit code " + strconv.Itoa(inspect.State.ExitCode),
+			}).Publish()
+			log.WithField("exit_code", inspect.State.ExitCode).Error("server crashed")
+		}
+	}
+
+	if s.Stdin.Conn != nil {
+		s.Stdin.Close()
+	}
+	s.State = Stopped
+	if err := s.Save(); err != nil {
+		log.WithError(err).Error("failed to save server state after stopping")
+	}
+}
+
+// ConsoleLogs returns the console log files of the server, the current one
+// first.
+func (s *Server) ConsoleLogs() ([]ConsoleLog, error) {
+	logs := []ConsoleLog{}
+
+	dir := s.consoleLogDir()
+	if info, err := os.Stat(filepath.Join(dir, "console.log")); err == nil {
+		logs = append(logs, ConsoleLog{
+			Name:       info.Name(),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime().Unix(),
+		})
+	}
+
+	files, err := utils.RotatedFiles(dir, "console")
+	if os.IsNotExist(err) {
+		return logs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		logs = append(logs, ConsoleLog{
+			Name:       f.Name(),
+			Size:       f.Size(),
+			Compressed: strings.HasSuffix(f.Name(), ".gz"),
+			ModifiedAt: f.ModTime().Unix(),
+		})
+	}
+
+	return logs, nil
+}
+
+// OpenConsoleLog opens a console log file of the server by its name.
+func (s *Server) OpenConsoleLog(name string) (*os.File, error) {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, "console") {
+		return nil, ErrConsoleLogNotFound
+	}
+
+	f, err := os.Open(filepath.Join(s.consoleLogDir(), name))
+	if os.IsNotExist(err) {
+		return nil, ErrConsoleLogNotFound
+	}
+
+	return f, err
+}
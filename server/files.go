@@ -1,55 +1,149 @@
 package server
 
 import (
+	"crypto/sha256"
 	"daemon/config"
 	"daemon/utils"
 	"errors"
-	"github.com/apex/log"
+	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 )
 
-func (s *Server) ReadFileContent(path string) (string, string, error) {
-	c := config.Get()
-	if path != "" && !strings.HasPrefix(path, "/") {
-		path = "/" + path
+var (
+	ErrFileConflict      = errors.New("file has been modified since it was read")
+	ErrPathOutsideVolume = errors.New("path is outside of the server volume")
+	ErrDiskQuota         = errors.New("not enough disk space available for this server")
+)
+
+// ReadFileContent returns the name, content and ETag of a file in the server
+// volume. The ETag changes whenever the content or modification time of the
+// file changes and can be passed to WriteFileContent to detect conflicts.
+func (s *Server) ReadFileContent(path string) (string, string, string, error) {
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return "", "", "", err
 	}
 
-	absPath := utils.Normalize(c.System.VolumesDirectory + "/" + s.Uuid + path)
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		return "", "", errors.New("file does not exist: " + absPath)
+	info, err := os.Stat(absPath)
+	if os.IsNotExist(err) {
+		return "", "", "", errors.New("file does not exist: " + absPath)
+	} else if err != nil {
+		return "", "", "", err
 	}
 
-	split := strings.Split(absPath, "/")
-	fileName := split[len(split)-1]
+	fileName := filepath.Base(absPath)
 
 	content, err := os.ReadFile(absPath)
 	if err != nil {
 		log.WithError(err).Errorf("failed to read file %s", absPath)
-		return fileName, "", err
+		return fileName, "", "", err
 	}
 
-	return fileName, string(content), nil
+	return fileName, string(content), fileETag(content, info), nil
 }
 
-func (s *Server) WriteFileContent(path string, content string) error {
-	c := config.Get()
-	if path != "" && !strings.HasPrefix(path, "/") {
-		path = "/" + path
+// WriteFileContent replaces the content of a file in the server volume. When
+// ifMatch is set, the file is only written if its current ETag matches, "*"
+// matching any existing file, and ErrFileConflict is returned otherwise. The
+// content is written to a temporary file first and renamed over the original,
+// so the file is never left half written. The ETag of the new content is
+// returned.
+func (s *Server) WriteFileContent(path string, content string, ifMatch string) (string, error) {
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return "", err
 	}
 
-	absPath := utils.Normalize(c.System.VolumesDirectory + "/" + s.Uuid + path)
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(absPath, 0755); err != nil {
-			return err
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(absPath); err == nil {
+		if info.IsDir() {
+			return "", errors.New("path is a directory: " + absPath)
+		}
+		mode = info.Mode().Perm()
+
+		if ifMatch != "" && ifMatch != "*" {
+			current, err := os.ReadFile(absPath)
+			if err != nil {
+				return "", err
+			}
+
+			if !etagMatches(ifMatch, fileETag(current, info)) {
+				return "", ErrFileConflict
+			}
+		}
+	} else if os.IsNotExist(err) {
+		if ifMatch != "" {
+			return "", ErrFileConflict
+		}
+
+		if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+			return "", err
 		}
+	} else {
+		return "", err
 	}
 
-	if err := os.WriteFile(absPath, []byte(content), 0644); err != nil {
-		return err
+	tmp, err := os.CreateTemp(filepath.Dir(absPath), "."+filepath.Base(absPath)+".*.tmp")
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	if _, err := tmp.WriteString(content); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), absPath); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", err
+	}
+
+	return fileETag([]byte(content), info), nil
+}
+
+func fileETag(content []byte, info os.FileInfo) string {
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("\"%x-%x\"", sum[:16], info.ModTime().UnixNano())
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if strings.Trim(tag, "\"") == strings.Trim(etag, "\"") {
+			return true
+		}
+	}
+
+	return false
 }
 
 type FileEntry struct {
@@ -60,12 +154,11 @@ type FileEntry struct {
 }
 
 func (s *Server) ListDirectory(path string) ([]FileEntry, error) {
-	c := *config.Get()
-	if path != "" && !strings.HasPrefix(path, "/") {
-		path = "/" + path
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
 	}
 
-	absPath := utils.Normalize(c.System.VolumesDirectory + "/" + s.Uuid + path)
 	if _, err := os.Stat(absPath); os.IsNotExist(err) {
 		return nil, errors.New("directory does not exist: " + absPath)
 	}
@@ -93,3 +186,124 @@ func (s *Server) ListDirectory(path string) ([]FileEntry, error) {
 
 	return files, nil
 }
+
+// VolumePath returns the absolute path of the server volume on the host.
+func (s *Server) VolumePath() string {
+	c := config.Get()
+	return utils.Normalize(c.System.VolumesDirectory + "/" + s.Uuid)
+}
+
+// resolvePath returns the absolute path of a path inside the server volume.
+// The path is cleaned as if it was rooted at the volume, so ".." segments can
+// never point outside of it. The symlinks of the part of the path that exists
+// are resolved too, and ErrPathOutsideVolume is returned when one of them
+// leads outside of the volume, as the server can create them in its volume.
+func (s *Server) resolvePath(p string) (string, error) {
+	root := s.VolumePath()
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	abs := filepath.Join(root, filepath.FromSlash(p))
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		return abs, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	existing, rest := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			full := filepath.Join(resolved, rest)
+			if !withinDir(realRoot, full) {
+				return "", ErrPathOutsideVolume
+			}
+
+			return full, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// a dangling symlink would be followed when the file is created.
+		if _, err := os.Lstat(existing); err == nil {
+			return "", ErrPathOutsideVolume
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing || existing == root {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// withinDir reports whether p is dir or a path below it.
+func withinDir(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// DiskUsage returns the total size in bytes of all files in the server volume
+// and its recycle bin.
+func (s *Server) DiskUsage() (int64, error) {
+	size, err := dirSize(s.VolumePath())
+	if err != nil {
+		return 0, err
+	}
+
+	trash, err := s.TrashUsage()
+	if err != nil {
+		return 0, err
+	}
+
+	return size + trash, nil
+}
+
+// dirSize returns the size in bytes of a file, or of all files below a
+// directory.
+func dirSize(root string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
+
+// checkDiskSpace returns ErrDiskQuota if writing size more bytes to the
+// volume would go over the disk limit of the server.
+func (s *Server) checkDiskSpace(size int64) error {
+	if s.Resources.Disk <= 0 {
+		return nil
+	}
+
+	usage, err := s.DiskUsage()
+	if err != nil {
+		return err
+	}
+
+	if usage+size > s.Resources.Disk {
+		return ErrDiskQuota
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"daemon/config"
+	"daemon/templates"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestServer returns a server whose volume is in a temporary directory,
+// next to a directory outside of it.
+func newTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	c := config.DefaultConfig(filepath.Join(dir, "config.yml"))
+	c.System.DataDirectory = filepath.Join(dir, "data")
+	c.System.VolumesDirectory = filepath.Join(dir, "volumes")
+	config.Set(c)
+
+	s := &Server{Id: "00000000", Uuid: "00000000-0000-0000-0000-000000000000"}
+	if err := os.MkdirAll(s.VolumePath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, outside
+}
+
+func symlink(t *testing.T, target string, link string) {
+	t.Helper()
+
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	s, outside := newTestServer(t)
+	volume := s.VolumePath()
+
+	if err := os.MkdirAll(filepath.Join(volume, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, outside, filepath.Join(volume, "plugins"))
+	symlink(t, filepath.Join(volume, "config"), filepath.Join(volume, "settings"))
+	symlink(t, filepath.Join(outside, "missing"), filepath.Join(volume, "dangling"))
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		outside bool
+	}{
+		{name: "root", path: "/", want: "."},
+		{name: "file", path: "/server.properties", want: "server.properties"},
+		{name: "missing directories", path: "config/a/b.yml", want: "config/a/b.yml"},
+		{name: "dot dot", path: "/../../etc/passwd", want: "etc/passwd"},
+		{name: "backslashes", path: "config\\..\\eula.txt", want: "eula.txt"},
+		{name: "symlink inside", path: "settings/a.yml", want: "config/a.yml"},
+		{name: "symlinked directory", path: "plugins/a.jar", outside: true},
+		{name: "symlinked directory itself", path: "plugins", outside: true},
+		{name: "missing below symlinked directory", path: "plugins/a/b/c", outside: true},
+		{name: "dangling symlink", path: "dangling", outside: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.resolvePath(tt.path)
+			if tt.outside {
+				if !errors.Is(err, ErrPathOutsideVolume) {
+					t.Fatalf("resolvePath(%q) = %q, %v, want ErrPathOutsideVolume", tt.path, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolvePath(%q) failed: %v", tt.path, err)
+			}
+
+			real, err := filepath.EvalSymlinks(volume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(real, filepath.FromSlash(tt.want)); got != want {
+				t.Fatalf("resolvePath(%q) = %q, want %q", tt.path, got, want)
+			}
+		})
+	}
+}
+
+func TestConfigFileThroughSymlinkIsRefused(t *testing.T) {
+	s, outside := newTestServer(t)
+	volume := s.VolumePath()
+	symlink(t, outside, filepath.Join(volume, "plugins"))
+
+	err := s.applyConfigFile(templates.ConfigFile{
+		Path:    "plugins/config.yml",
+		Parser:  "yaml",
+		Content: "a: b\n",
+	}, map[string]string{})
+	if !errors.Is(err, ErrPathOutsideVolume) {
+		t.Fatalf("writing a config file through a symlink returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "config.yml")); !os.IsNotExist(err) {
+		t.Fatal("a config file was written outside of the volume")
+	}
+}
+
+func TestTrashThroughSymlink(t *testing.T) {
+	s, outside := newTestServer(t)
+	volume := s.VolumePath()
+	symlink(t, outside, filepath.Join(volume, "plugins"))
+
+	if err := os.WriteFile(filepath.Join(volume, "world.dat"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteFile("world.dat"); err != nil {
+		t.Fatal(err)
+	}
+	items, err := s.ListTrash()
+	if err != nil || len(items) != 1 {
+		t.Fatalf("ListTrash() = %v, %v", items, err)
+	}
+	if _, err := s.RestoreTrash(items[0].Id, "plugins/world.dat"); !errors.Is(err, ErrPathOutsideVolume) {
+		t.Fatalf("restoring into a symlinked directory returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "world.dat")); !os.IsNotExist(err) {
+		t.Fatal("a trash item was restored outside of the volume")
+	}
+
+	if err := s.DeleteFile("plugins"); err != nil {
+		t.Fatalf("deleting the symlink itself failed: %v", err)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("the target of a deleted symlink was removed: %v", err)
+	}
+}
+
+func TestFileContentStaysInVolume(t *testing.T) {
+	s, outside := newTestServer(t)
+	secret := filepath.Join(outside, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, outside, filepath.Join(s.VolumePath(), "plugins"))
+
+	if _, err := s.WriteFileContent("../../outside/secret.txt", "changed", ""); err != nil {
+		t.Fatalf("WriteFileContent failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.VolumePath(), "outside", "secret.txt")); err != nil {
+		t.Fatalf("a path with .. segments wasn't kept in the volume: %v", err)
+	}
+
+	if _, _, _, err := s.ReadFileContent("plugins/secret.txt"); !errors.Is(err, ErrPathOutsideVolume) {
+		t.Fatalf("reading through a symlink returned %v", err)
+	}
+	if _, err := s.WriteFileContent("plugins/secret.txt", "changed", ""); !errors.Is(err, ErrPathOutsideVolume) {
+		t.Fatalf("writing through a symlink returned %v", err)
+	}
+	if _, err := s.ListDirectory("plugins"); !errors.Is(err, ErrPathOutsideVolume) {
+		t.Fatalf("listing through a symlink returned %v", err)
+	}
+
+	if b, _ := os.ReadFile(secret); string(b) != "secret" {
+		t.Fatalf("the file outside of the volume was changed to %q", b)
+	}
+}
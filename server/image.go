@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"daemon/config"
+	"daemon/events"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrImageNotPresent = errors.New("image is not present and the pull policy doesn't allow pulling it")
+
+// The pull policies of config.DockerConfig.PullPolicy. Unknown policies are
+// handled as PullIfNotPresent.
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// LayerProgress is how far the pull of an image layer is. The download is the
+// first half of the percentage, the extraction the second.
+type LayerProgress struct {
+	Status  string  `json:"status"`
+	Percent float64 `json:"percent"`
+}
+
+// imagePull is a running pull of an image, shared by the servers that need
+// the image at the same time.
+type imagePull struct {
+	image string
+	done  chan struct{}
+	err   error
+
+	mu      sync.Mutex
+	servers map[string]bool
+	layers  map[string]*LayerProgress
+}
+
+// pullMessage is a line of the JSON stream of an image pull.
+type pullMessage struct {
+	Id             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+var (
+	imagePullsMu sync.Mutex
+	imagePulls   = map[string]*imagePull{}
+)
+
+// pullImage makes sure the image is present, pulling it as the pull policy
+// says. The progress is published as events.ServerImagePull events for the
+// server. A pull of an image that is already being pulled waits for that pull
+// instead of starting another one.
+func pullImage(ctx context.Context, cli *client.Client, s *Server, name string) error {
+	policy := config.Get().Docker.PullPolicy
+	if policy != PullAlways {
+		_, err := cli.ImageInspect(ctx, name)
+		if err == nil {
+			log.WithField("server", s.Uuid).Debugf("image %s is present, skipping the pull", name)
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		if policy == PullNever {
+			return fmt.Errorf("%w: %s", ErrImageNotPresent, name)
+		}
+	}
+
+	imagePullsMu.Lock()
+	p, ok := imagePulls[name]
+	if !ok {
+		p = &imagePull{
+			image:   name,
+			done:    make(chan struct{}),
+			servers: map[string]bool{},
+			layers:  map[string]*LayerProgress{},
+		}
+		imagePulls[name] = p
+		s.Go("image pull", func() {
+			p.run(cli)
+		})
+	}
+	p.mu.Lock()
+	p.servers[s.Uuid] = true
+	p.mu.Unlock()
+	imagePullsMu.Unlock()
+
+	// the pull isn't cancelled with ctx, as other servers may be waiting for
+	// it too.
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.servers, s.Uuid)
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (p *imagePull) run(cli *client.Client) {
+	defer func() {
+		imagePullsMu.Lock()
+		delete(imagePulls, p.image)
+		imagePullsMu.Unlock()
+
+		close(p.done)
+	}()
+
+	log.Infof("pulling image %s", p.image)
+	p.publish("pulling")
+
+	if err := p.pull(cli); err != nil {
+		log.WithError(err).Errorf("failed to pull image %s", p.image)
+		p.err = err
+		p.publish("failed")
+		return
+	}
+
+	log.Infof("pulled image %s", p.image)
+	p.publish("completed")
+}
+
+func (p *imagePull) pull(cli *client.Client) error {
+	auth, err := registryAuth(p.image)
+	if err != nil {
+		return err
+	}
+
+	reader, err := cli.ImagePull(context.Background(), p.image, image.PullOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	dec := json.NewDecoder(reader)
+	last := time.Now()
+	for {
+		var m pullMessage
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if m.ErrorDetail.Message != "" {
+			return errors.New(m.ErrorDetail.Message)
+		}
+		if m.Error != "" {
+			return errors.New(m.Error)
+		}
+
+		p.update(m)
+		if time.Since(last) > 500*time.Millisecond {
+			last = time.Now()
+			p.publish("pulling")
+		}
+	}
+}
+
+// update applies a message of the pull stream to the progress of its layer.
+func (p *imagePull) update(m pullMessage) {
+	if m.Id == "" {
+		return
+	}
+
+	var percent float64
+	switch m.Status {
+	case "Pulling fs layer", "Waiting":
+		percent = 0
+	case "Downloading":
+		percent = 50 * fraction(m.ProgressDetail.Current, m.ProgressDetail.Total)
+	case "Verifying Checksum", "Download complete":
+		percent = 50
+	case "Extracting":
+		percent = 50 + 50*fraction(m.ProgressDetail.Current, m.ProgressDetail.Total)
+	case "Pull complete", "Already exists":
+		percent = 100
+	default:
+		// not a layer, like the tag the image is pulled from.
+		return
+	}
+
+	p.mu.Lock()
+	p.layers[m.Id] = &LayerProgress{Status: m.Status, Percent: percent}
+	p.mu.Unlock()
+}
+
+func fraction(current int64, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	if current >= total {
+		return 1
+	}
+
+	return float64(current) / float64(total)
+}
+
+// publish sends the progress of the pull to every server waiting for it.
+func (p *imagePull) publish(status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	layers := make(map[string]LayerProgress, len(p.layers))
+	var total float64
+	for id, l := range p.layers {
+		layers[id] = *l
+		total += l.Percent
+	}
+
+	progress := float64(0)
+	if status == "completed" {
+		progress = 100
+	} else if len(layers) > 0 {
+		progress = total / float64(len(layers))
+	}
+
+	for uuid := range p.servers {
+		payload := map[string]interface{}{
+			"server":   uuid,
+			"image":    p.image,
+			"status":   status,
+			"progress": progress,
+			"layers":   layers,
+		}
+		if p.err != nil {
+			payload["error"] = p.err.Error()
+		}
+
+		events.ForServer(uuid, events.ServerImagePull, payload).Publish()
+	}
+}
+
+// registryAuth returns the encoded credentials of the registry the image is
+// pulled from, or an empty string when none are configured for it.
+func registryAuth(name string) (string, error) {
+	host := imageHost(name)
+
+	registries := config.Get().Docker.Registries
+	r, ok := registries[host]
+	if !ok && host == "docker.io" {
+		for _, alias := range []string{"index.docker.io", "registry-1.docker.io", "https://index.docker.io/v1/"} {
+			if r, ok = registries[alias]; ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		return "", nil
+	}
+
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      r.Username,
+		Password:      r.Password,
+		ServerAddress: host,
+	})
+}
+
+// imageHost returns the registry of an image reference. Like docker does, the
+// first part of the name is the registry when it looks like a host, otherwise
+// the image is on Docker Hub.
+func imageHost(name string) string {
+	first, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return "docker.io"
+	}
+
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return first
+	}
+
+	return "docker.io"
+}
@@ -7,39 +7,97 @@ import (
 	"daemon/events"
 	"daemon/templates"
 	"daemon/utils"
-	"github.com/apex/log"
+	"errors"
+	"fmt"
 	"github.com/docker/docker/api/types/container"
-	image2 "github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+var (
+	ErrServerInstalling = errors.New("server is already being installed")
+	ErrNotInstalling    = errors.New("server is not being installed")
+	ErrInstallCancelled = errors.New("install was cancelled")
+)
+
+var (
+	installsMu sync.Mutex
+	installs   = map[string]context.CancelFunc{}
+)
+
 type InstallProcess struct {
 	Server *Server
 	client *client.Client
 }
 
-func (i *InstallProcess) installServer(reinstall bool) error {
+// CancelInstall removes the server from the install queue, or stops its
+// running install. A waiting install hasn't touched the server yet, so the
+// server returns to the state it had before it was queued. A running install
+// fails.
+func (s *Server) CancelInstall() error {
+	if job, ok := s.dequeue(); ok {
+		(&InstallProcess{Server: s}).cancelled(job.previous)
+		return nil
+	}
+
+	installsMu.Lock()
+	cancel, ok := installs[s.Uuid]
+	installsMu.Unlock()
+	if !ok {
+		return ErrNotInstalling
+	}
+
+	cancel()
+	return nil
+}
+
+func (i *InstallProcess) installServer(reinstall bool) (err error) {
 	c := *config.Get()
 	cli := i.client
-
 	s := i.Server
-	s.State = Installing
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	installsMu.Lock()
+	if _, ok := installs[s.Uuid]; ok {
+		installsMu.Unlock()
+		return ErrServerInstalling
+	}
+	installs[s.Uuid] = cancel
+	installsMu.Unlock()
+
+	defer func() {
+		installsMu.Lock()
+		delete(installs, s.Uuid)
+		installsMu.Unlock()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ErrInstallCancelled
+			}
+			i.failed(err)
+			return
+		}
+		i.succeeded()
+	}()
+
+	s.State = Installing
 	if reinstall {
 		id := s.DockerId
 		if err := cli.ContainerRemove(ctx, id, container.RemoveOptions{
 			Force:         true,
 			RemoveVolumes: false,
 			RemoveLinks:   false,
-		}); err != nil {
+		}); err != nil && !client.IsErrNotFound(err) {
 			return err
 		}
 
@@ -51,15 +109,25 @@ func (i *InstallProcess) installServer(reinstall bool) error {
 		}
 	}
 
-	var reader io.ReadCloser
-	var err error
-	if reader, err = cli.ImagePull(ctx, s.Container.Image, image2.PullOptions{}); err != nil {
+	t, err := templates.GetTemplate(s.Template)
+	if err != nil {
 		return err
 	}
+	s.TemplateVersion = t.Version
 
-	if _, err := io.Copy(os.Stdout, reader); err != nil {
+	installImage := t.Install.Image
+	if installImage == "" {
+		installImage = s.Container.Image
+	}
+
+	if err := pullImage(ctx, cli, s, s.Container.Image); err != nil {
 		return err
 	}
+	if installImage != s.Container.Image {
+		if err := pullImage(ctx, cli, s, installImage); err != nil {
+			return err
+		}
+	}
 
 	volumeDir := utils.Normalize(c.System.VolumesDirectory + "/" + s.Uuid)
 	if _, err := os.Stat(volumeDir); os.IsNotExist(err) {
@@ -68,62 +136,32 @@ func (i *InstallProcess) installServer(reinstall bool) error {
 		}
 	}
 
-	t, err := templates.GetTemplate(s.Template)
-	if err != nil {
-		return err
-	}
-
-	ev := events.New(events.ServerInstallStarted, "")
+	ev := events.ForServer(i.Server.Uuid, events.ServerInstallStarted, "")
 	ev.Publish()
-	defer func() {
-		events.New(events.ServerInstallFinished, s).Publish()
-		events.New(events.ServerLog, map[string]interface{}{
-			"daemon":  true,
-			"message": "Installation process completed successfully",
-		}).Publish()
-
-		err := i.Server.Power(PowerStart)
-		if err != nil {
-			log.WithError(err).Errorf("failed to start server %s after installation", s.Uuid)
-			events.New(events.ServerLog, map[string]interface{}{
-				"daemon":  true,
-				"message": "\u001b[41mFailed to start server after installation: " + err.Error(),
-			})
-		}
-	}()
-
-	envs := []string{
-		"IP=" + s.Allocations.DefaultMapping.Ip,
-		"PORT=" + strconv.Itoa(s.Allocations.DefaultMapping.Port),
-		"UUID=" + s.Uuid,
-		"NAME=" + s.Name,
-		"DESCRIPTION=" + s.Description,
-		"IMAGE=" + s.Container.Image,
-	}
-	for k, v := range s.Container.Variables {
-		envs = append(envs, k+"="+v)
-	}
 
-	events.New(events.ServerLog, map[string]interface{}{
+	events.ForServer(i.Server.Uuid, events.ServerLog, map[string]interface{}{
 		"daemon":  true,
 		"message": "Starting installation of server",
 	}).Publish()
 
+	entrypoint := t.Install.Entrypoint
+	if entrypoint == "" {
+		entrypoint = "sh"
+	}
+
 	a := s.Allocations
 	containerConfig := &container.Config{
 		Hostname:     "installer",
 		Domainname:   c.Docker.DomainName,
-		Image:        s.Container.Image,
+		Image:        installImage,
 		AttachStderr: true,
 		AttachStdout: true,
 		AttachStdin:  true,
 		OpenStdin:    true,
 		Tty:          true,
-		Env:          envs,
-		Cmd: []string{
-			"sh",
-			"/mnt/install/install.sh",
-		},
+		Env:          s.containerEnv(),
+		Entrypoint:   []string{entrypoint},
+		Cmd:          []string{"/mnt/install/install.sh"},
 		ExposedPorts: a.Exposed(),
 	}
 
@@ -133,29 +171,16 @@ func (i *InstallProcess) installServer(reinstall bool) error {
 		return err
 	}
 
-	installDir := s.tempInstallDir()
+	installDir, err := s.tempInstallDir()
+	if err != nil {
+		return err
+	}
 	tmpfs := strconv.Itoa(int(c.Docker.TmpfsSize))
 	log.Debugf("port bindings: %v", a.DockerBindings())
 	hostConfig := &container.HostConfig{
 		PortBindings: a.DockerBindings(),
-		Mounts: []mount.Mount{
-			{
-				Target:   "/mnt/data",
-				Source:   strings.ReplaceAll(volumeDir, "\\", "/"),
-				Type:     mount.TypeBind,
-				ReadOnly: false,
-			},
-			{
-				Target:   "/mnt/install",
-				Source:   strings.ReplaceAll(installDir, "\\", "/"),
-				Type:     mount.TypeBind,
-				ReadOnly: false,
-			},
-		},
-		Resources: container.Resources{
-			Memory:    s.Resources.Memory,
-			CPUShares: s.Resources.Cpu,
-		},
+		Mounts:       installMounts(volumeDir, installDir),
+		Resources:    installResources(c, t),
 		Tmpfs: map[string]string{
 			"/tmp": "rw,noexec,nosuid,size=" + tmpfs + "m",
 		},
@@ -175,8 +200,7 @@ func (i *InstallProcess) installServer(reinstall bool) error {
 	}()
 
 	log.Infof("installing server %s", s.Uuid)
-	installScript := []byte(t.InstallScript)
-	if err = os.WriteFile(installDir+"\\install.sh", installScript, 0644); err != nil {
+	if err = writeInstallScript(installDir, t.InstallScript); err != nil {
 		return err
 	}
 
@@ -193,19 +217,37 @@ func (i *InstallProcess) installServer(reinstall bool) error {
 		return err
 	}
 
-	go func(id string) {
-		if err := i.Output(ctx, id); err != nil {
-			log.WithError(err).Fatal("failed to output")
+	// the output is read until the container is gone, even when the install
+	// returns first.
+	id := response.ID
+	s.Go("install output", func() {
+		if err := i.Output(context.WithoutCancel(ctx), id); err != nil {
+			s.ReportError(fmt.Errorf("failed to read the install output: %w", err))
 		}
-	}(response.ID)
+	})
+
+	timeout := time.Duration(c.Install.Timeout) * time.Second
+	if t.Install.Timeout > 0 {
+		timeout = time.Duration(t.Install.Timeout) * time.Second
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	sChan, eChan := cli.ContainerWait(ctx, response.ID, container.WaitConditionNotRunning)
+	sChan, eChan := cli.ContainerWait(waitCtx, response.ID, container.WaitConditionNotRunning)
 	select {
 	case err := <-eChan:
 		if err != nil {
+			i.removeInstallContainer(response.ID)
+			if ctx.Err() != nil {
+				return ErrInstallCancelled
+			}
+			if errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("install did not finish within %s", timeout)
+			}
 			return err
 		}
-	case <-sChan:
+	case res := <-sChan:
 		if err := cli.ContainerRemove(ctx, response.ID, container.RemoveOptions{
 			Force:         true,
 			RemoveVolumes: false,
@@ -214,25 +256,21 @@ func (i *InstallProcess) installServer(reinstall bool) error {
 			return err
 		}
 
-		containerConfig.WorkingDir = "/mnt/data"
-		containerConfig.Hostname = s.Uuid
-		containerConfig.Cmd = strings.Split(s.Container.StartupCommand, " ")
-
-		hostConfig.Mounts = []mount.Mount{
-			{
-				Target:   "/mnt/data",
-				Source:   strings.ReplaceAll(volumeDir, "\\", "/"),
-				Type:     mount.TypeBind,
-				ReadOnly: false,
-			},
+		if res.Error != nil {
+			return errors.New(res.Error.Message)
+		}
+		if res.StatusCode != 0 {
+			return fmt.Errorf("install script exited with code %d", res.StatusCode)
 		}
 
+		containerConfig, hostConfig = s.runtimeConfig(c, mode)
 		if response, err = cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, s.Uuid); err != nil {
 			return err
 		}
 
 		s.DockerId = response.ID
 		s.Container.Installed = true
+		s.Container.InstallError = ""
 		s.UpdatedAt = time.Now().Unix()
 		s.State = Stopped
 
@@ -244,6 +282,227 @@ func (i *InstallProcess) installServer(reinstall bool) error {
 	return nil
 }
 
+// containerEnv returns the environment of the install and the runtime
+// containers of the server.
+func (s *Server) containerEnv() []string {
+	envs := []string{
+		"IP=" + s.Allocations.DefaultMapping.Ip,
+		"PORT=" + strconv.Itoa(s.Allocations.DefaultMapping.Port),
+		"UUID=" + s.Uuid,
+		"NAME=" + s.Name,
+		"DESCRIPTION=" + s.Description,
+		"IMAGE=" + s.Container.Image,
+	}
+	for k, v := range s.StartupVariables() {
+		envs = append(envs, k+"="+v)
+	}
+
+	return envs
+}
+
+// runtimeConfig returns the config of the container the server runs in, with
+// the startup command rendered from its current variables, resources and
+// allocation.
+func (s *Server) runtimeConfig(c config.Config, mode container.NetworkMode) (*container.Config, *container.HostConfig) {
+	a := s.Allocations
+	entrypoint, cmd := s.StartupCmd()
+	containerConfig := &container.Config{
+		Hostname:     s.Uuid,
+		Domainname:   c.Docker.DomainName,
+		Image:        s.Container.Image,
+		WorkingDir:   "/mnt/data",
+		AttachStderr: true,
+		AttachStdout: true,
+		AttachStdin:  true,
+		OpenStdin:    true,
+		Tty:          true,
+		Env:          s.containerEnv(),
+		Entrypoint:   entrypoint,
+		Cmd:          cmd,
+		ExposedPorts: a.Exposed(),
+	}
+
+	tmpfs := strconv.Itoa(int(c.Docker.TmpfsSize))
+	hostConfig := &container.HostConfig{
+		PortBindings: a.DockerBindings(),
+		Mounts: []mount.Mount{
+			{
+				Target:   "/mnt/data",
+				Source:   strings.ReplaceAll(s.VolumePath(), "\\", "/"),
+				Type:     mount.TypeBind,
+				ReadOnly: false,
+			},
+		},
+		Resources: container.Resources{
+			Memory:    s.Resources.Memory,
+			CPUShares: s.Resources.Cpu,
+		},
+		Tmpfs: map[string]string{
+			"/tmp": "rw,noexec,nosuid,size=" + tmpfs + "m",
+		},
+		DNS:         c.Docker.Network.Dns,
+		NetworkMode: mode,
+		UsernsMode:  container.UsernsMode(c.Docker.UsernsMode),
+		CapDrop: []string{
+			"setpcap", "mknod", "audit_write", "net_raw", "dac_override",
+			"fowner", "fsetid", "net_bind_service", "sys_chroot", "setfcap",
+		},
+		SecurityOpt: []string{"no-new-privileges"},
+	}
+
+	return containerConfig, hostConfig
+}
+
+// recreateContainer replaces the container of an installed server with one
+// made from its current config, so changes to its variables, resources and
+// allocation since the last start apply. The data of the server is in its
+// volume, not in the container.
+func (s *Server) recreateContainer(ctx context.Context, cli *client.Client) error {
+	if !s.Container.Installed {
+		return nil
+	}
+
+	i := &InstallProcess{Server: s, client: cli}
+	mode, err := i.setupNetwork(ctx, cli, s)
+	if err != nil {
+		return err
+	}
+
+	if s.DockerId != "" {
+		if err := cli.ContainerRemove(ctx, s.DockerId, container.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+			return err
+		}
+	}
+
+	containerConfig, hostConfig := s.runtimeConfig(*config.Get(), mode)
+	response, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, s.Uuid)
+	if err != nil {
+		return err
+	}
+
+	s.DockerId = response.ID
+	s.UpdatedAt = time.Now().Unix()
+	return s.Save()
+}
+
+// removeInstallContainer removes the install container after the install was
+// stopped before it finished.
+func (i *InstallProcess) removeInstallContainer(id string) {
+	if err := i.client.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true}); err != nil {
+		log.WithError(err).Warnf("failed to remove the install container of server %s", i.Server.Uuid)
+	}
+}
+
+// succeeded reports a finished install and starts the server.
+func (i *InstallProcess) succeeded() {
+	s := i.Server
+
+	events.ForServer(i.Server.Uuid, events.ServerInstallFinished, s).Publish()
+	events.ForServer(i.Server.Uuid, events.ServerLog, map[string]interface{}{
+		"daemon":  true,
+		"message": "Installation process completed successfully",
+	}).Publish()
+
+	if err := s.Power(PowerStart); err != nil {
+		log.WithError(err).Errorf("failed to start server %s after installation", s.Uuid)
+		events.ForServer(i.Server.Uuid, events.ServerLog, map[string]interface{}{
+			"daemon":  true,
+			"message": "\u001b[41mFailed to start server after installation: " + err.Error(),
+		}).Publish()
+	}
+}
+
+// cancelled reports an install that was cancelled before it started, and
+// puts the server back in the state it had before.
+func (i *InstallProcess) cancelled(previous State) {
+	s := i.Server
+
+	log.WithField("server", s.Uuid).Info("queued install was cancelled")
+	s.State = previous
+	if s.State == Queued || s.State == Installing {
+		s.State = Stopped
+	}
+	s.UpdatedAt = time.Now().Unix()
+	if err := s.Save(); err != nil {
+		log.WithError(err).Warnf("failed to save server %s", s.Uuid)
+	}
+
+	events.ForServer(i.Server.Uuid, events.ServerInstallCancelled, map[string]interface{}{
+		"server": s.Uuid,
+		"state":  s.State.String(),
+	}).Publish()
+	events.ForServer(i.Server.Uuid, events.ServerLog, map[string]interface{}{
+		"daemon":  true,
+		"message": "Installation was cancelled before it started",
+	}).Publish()
+}
+
+// failed marks the server as not installed with the reason the install failed.
+// The install log is kept in the volume of the server.
+func (i *InstallProcess) failed(err error) {
+	s := i.Server
+
+	log.WithError(err).WithField("server", s.Uuid).Error("server install failed")
+	s.State = Stopped
+	s.Container.Installed = false
+	s.Container.InstallError = err.Error()
+	s.UpdatedAt = time.Now().Unix()
+	if err := s.Save(); err != nil {
+		log.WithError(err).Warnf("failed to save server %s", s.Uuid)
+	}
+
+	events.ForServer(i.Server.Uuid, events.ServerInstallFailed, map[string]interface{}{
+		"server": s.Uuid,
+		"error":  err.Error(),
+	}).Publish()
+	events.ForServer(i.Server.Uuid, events.ServerLog, map[string]interface{}{
+		"daemon":  true,
+		"message": "\u001b[41mInstallation failed: " + err.Error(),
+	}).Publish()
+}
+
+// installMounts returns the mounts of the install container: the server
+// volume, and the directory holding the install script.
+func installMounts(volumeDir string, installDir string) []mount.Mount {
+	return []mount.Mount{
+		{
+			Target:   "/mnt/data",
+			Source:   volumeDir,
+			Type:     mount.TypeBind,
+			ReadOnly: false,
+		},
+		{
+			Target:   "/mnt/install",
+			Source:   installDir,
+			Type:     mount.TypeBind,
+			ReadOnly: false,
+		},
+	}
+}
+
+// writeInstallScript writes the install script in the install directory, from
+// where the install container runs it as /mnt/install/install.sh.
+func writeInstallScript(installDir string, script string) error {
+	return os.WriteFile(filepath.Join(installDir, "install.sh"), []byte(script), 0644)
+}
+
+// installResources returns the limits of the install container, which are the
+// ones of the template or else the ones of the config.
+func installResources(c config.Config, t templates.Template) container.Resources {
+	r := container.Resources{
+		Memory:    c.Install.Memory,
+		CPUShares: c.Install.Cpu,
+	}
+	if t.Install.Memory > 0 {
+		r.Memory = t.Install.Memory
+	}
+	if t.Install.Cpu > 0 {
+		r.CPUShares = t.Install.Cpu
+	}
+
+	return r
+}
+
 func (i *InstallProcess) Output(ctx context.Context, id string) error {
 	c := *config.Get()
 	cli := i.client
@@ -259,16 +518,12 @@ func (i *InstallProcess) Output(ctx context.Context, id string) error {
 	defer func(reader io.ReadCloser) {
 		err := reader.Close()
 		if err != nil {
-			log.WithError(err).Fatal("failed to close reader")
+			log.WithError(err).Error("failed to close install output reader")
 		}
 	}(reader)
 
 	installLog := utils.Normalize(c.System.VolumesDirectory + "/" + i.Server.Uuid + "/install.log")
-	if _, err := os.Create(installLog); err != nil {
-		return err
-	}
-
-	file, err := os.OpenFile(installLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(installLog, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
@@ -289,10 +544,10 @@ func (i *InstallProcess) Output(ctx context.Context, id string) error {
 		}
 
 		log.Info(line)
-		events.New(events.ServerLog, map[string]interface{}{
+		events.ForServer(i.Server.Uuid, events.ServerLog, map[string]interface{}{
 			"daemon":  false,
 			"message": line,
-		})
+		}).Publish()
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -300,11 +555,6 @@ func (i *InstallProcess) Output(ctx context.Context, id string) error {
 		return err
 	}
 
-	log.Info("installation process completed successfully")
-	events.New(events.ServerLog, map[string]interface{}{
-		"daemon":  true,
-		"message": "Installation process completed successfully",
-	})
 	return nil
 }
 
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstallScriptIsInMountedDirectory(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	installDir, err := s.tempInstallDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeInstallScript(installDir, "#!/bin/sh\necho installed\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range installMounts(s.VolumePath(), installDir) {
+		if m.Target != "/mnt/install" {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(m.Source, "install.sh"))
+		if err != nil {
+			t.Fatalf("the install script isn't in the mounted directory: %v", err)
+		}
+		if string(b) != "#!/bin/sh\necho installed\n" {
+			t.Fatalf("install.sh = %q", b)
+		}
+
+		entries, err := os.ReadDir(filepath.Dir(installDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				t.Fatalf("the install script left a file %q next to the install directory", e.Name())
+			}
+		}
+		return
+	}
+
+	t.Fatal("the install directory isn't mounted at /mnt/install")
+}
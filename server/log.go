@@ -0,0 +1,5 @@
+package server
+
+import "daemon/logging"
+
+var log = logging.For("server")
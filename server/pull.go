@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"daemon/config"
+	"daemon/events"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrPullDisabled   = errors.New("remote downloads are disabled on this node")
+	ErrPullInProgress = errors.New("a remote download is already in progress for this server")
+	ErrPullDenied     = errors.New("downloading from private or loopback addresses is not allowed")
+	ErrPullTooLarge   = errors.New("remote file exceeds the maximum download size")
+
+	pullsMu sync.Mutex
+	pulls   = map[string]*Pull{}
+)
+
+type Pull struct {
+	Url        string `json:"url"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+	StartedAt  int64  `json:"started_at"`
+
+	server *Server
+	body   io.ReadCloser
+	target string
+	cancel context.CancelFunc
+}
+
+// PullFile starts downloading the file at the given URL into a directory of
+// the server volume. The request is made and validated before returning, the
+// body is then written to disk in the background and the progress is
+// published as events.ServerFilePull events.
+func (s *Server) PullFile(rawUrl string, directory string, fileName string) (*Pull, error) {
+	c := config.Get().Files.Pull
+	if !c.Enabled {
+		return nil, ErrPullDisabled
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("only http and https urls are supported")
+	}
+
+	pullsMu.Lock()
+	if _, ok := pulls[s.Uuid]; ok {
+		pullsMu.Unlock()
+		return nil, ErrPullInProgress
+	}
+
+	p := &Pull{
+		Url:       u.String(),
+		StartedAt: time.Now().Unix(),
+		server:    s,
+	}
+	pulls[s.Uuid] = p
+	pullsMu.Unlock()
+
+	if err := p.open(directory, fileName); err != nil {
+		p.release()
+		return nil, err
+	}
+
+	// the download keeps updating p, so the caller gets a copy of it.
+	started := *p
+	s.Go("pull", p.download)
+	return &started, nil
+}
+
+func (p *Pull) open(directory string, fileName string) error {
+	c := config.Get().Files.Pull
+	s := p.server
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout)*time.Second)
+	p.cancel = cancel
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !c.AllowPrivate {
+		dialer.Control = denyPrivateAddress
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > c.MaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Zephyr Daemon")
+
+	res, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrPullDenied) {
+			return ErrPullDenied
+		}
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		_ = res.Body.Close()
+		return fmt.Errorf("remote server responded with status %d", res.StatusCode)
+	}
+
+	if res.ContentLength > 0 {
+		if c.MaxSize > 0 && res.ContentLength > c.MaxSize {
+			_ = res.Body.Close()
+			return ErrPullTooLarge
+		}
+
+		if err := s.checkDiskSpace(res.ContentLength); err != nil {
+			_ = res.Body.Close()
+			return err
+		}
+	}
+
+	if fileName == "" {
+		if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+			fileName = params["filename"]
+		}
+	}
+	if fileName == "" {
+		fileName = path.Base(res.Request.URL.Path)
+	}
+
+	fileName = path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if fileName == "" || fileName == "." || fileName == "/" {
+		_ = res.Body.Close()
+		return errors.New("unable to determine a file name for the download")
+	}
+
+	dir, err := s.resolvePath(directory)
+	if err != nil {
+		_ = res.Body.Close()
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		_ = res.Body.Close()
+		return err
+	}
+
+	p.Path = path.Join("/", strings.ReplaceAll(directory, "\\", "/"), fileName)
+	if p.target, err = s.resolvePath(p.Path); err != nil {
+		_ = res.Body.Close()
+		return err
+	}
+	p.Size = res.ContentLength
+	p.body = res.Body
+	return nil
+}
+
+func (p *Pull) download() {
+	defer p.release()
+	defer p.body.Close()
+
+	if err := p.write(); err != nil {
+		log.WithError(err).WithField("server", p.server.Uuid).Error("failed to download remote file")
+		p.publish("failed", err)
+		return
+	}
+
+	log.WithField("server", p.server.Uuid).Infof("downloaded %s to %s", p.Url, p.Path)
+	p.publish("completed", nil)
+}
+
+func (p *Pull) write() error {
+	c := config.Get().Files.Pull
+	s := p.server
+
+	free := int64(-1)
+	if s.Resources.Disk > 0 {
+		usage, err := s.DiskUsage()
+		if err != nil {
+			return err
+		}
+		free = s.Resources.Disk - usage
+	}
+
+	tmp := p.target + ".pull"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	p.publish("downloading", nil)
+	buf := make([]byte, 32*1024)
+	last := time.Now()
+	for {
+		n, rerr := p.body.Read(buf)
+		if n > 0 {
+			p.Downloaded += int64(n)
+			if c.MaxSize > 0 && p.Downloaded > c.MaxSize {
+				rerr = ErrPullTooLarge
+			} else if free >= 0 && p.Downloaded > free {
+				rerr = ErrDiskQuota
+			} else if _, err := file.Write(buf[:n]); err != nil {
+				rerr = err
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+
+		if rerr != nil {
+			_ = file.Close()
+			_ = os.Remove(tmp)
+			return rerr
+		}
+
+		if time.Since(last) > 500*time.Millisecond {
+			last = time.Now()
+			p.publish("downloading", nil)
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, p.target)
+}
+
+func (p *Pull) publish(status string, err error) {
+	payload := map[string]interface{}{
+		"server":     p.server.Uuid,
+		"url":        p.Url,
+		"path":       p.Path,
+		"size":       p.Size,
+		"downloaded": p.Downloaded,
+		"status":     status,
+	}
+	if err != nil {
+		payload["error"] = err.Error()
+	}
+
+	events.ForServer(p.server.Uuid, events.ServerFilePull, payload).Publish()
+}
+
+func (p *Pull) release() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+
+	pullsMu.Lock()
+	defer pullsMu.Unlock()
+
+	if pulls[p.server.Uuid] == p {
+		delete(pulls, p.server.Uuid)
+	}
+}
+
+func denyPrivateAddress(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return ErrPullDenied
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"daemon/config"
+	"daemon/env"
+	"daemon/events"
+	"daemon/utils"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// installJob is an install in the queue. Running installs stay in the saved
+// queue until they are done, so the ones a restart interrupted are resumed.
+type installJob struct {
+	Server    string `json:"server"`
+	Reinstall bool   `json:"reinstall"`
+
+	// previous is the state of the server before it was queued, which it
+	// returns to when the install is cancelled before it starts.
+	previous State
+}
+
+var (
+	queueMu sync.Mutex
+	queue   []installJob
+	active  = map[string]installJob{}
+)
+
+func queuePath() string {
+	return utils.Normalize(config.Get().System.DataDirectory + "/install_queue.json")
+}
+
+// QueueInstall adds an install of the server to the install queue. At most
+// the configured number of installs run at the same time, the others wait
+// for their turn.
+func (s *Server) QueueInstall(reinstall bool) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if _, ok := active[s.Uuid]; ok || queued(s.Uuid) >= 0 {
+		return ErrServerInstalling
+	}
+
+	queue = append(queue, installJob{Server: s.Uuid, Reinstall: reinstall, previous: s.State})
+	s.State = Queued
+
+	dispatch()
+	publishPositions()
+	return nil
+}
+
+// InstallPosition returns the position of the server in the install queue,
+// starting at 1, or 0 when it isn't waiting to be installed.
+func (s *Server) InstallPosition() int {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	return queued(s.Uuid) + 1
+}
+
+// dequeue removes a waiting install of the server from the queue, and returns
+// it. Running installs are cancelled with CancelInstall.
+func (s *Server) dequeue() (installJob, bool) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	n := queued(s.Uuid)
+	if n < 0 {
+		return installJob{}, false
+	}
+
+	job := queue[n]
+	queue = append(queue[:n], queue[n+1:]...)
+	if err := saveQueue(); err != nil {
+		log.WithError(err).Warn("failed to save the install queue")
+	}
+
+	publishPositions()
+	return job, true
+}
+
+// queued returns the index of the server in the queue, or -1. The caller must
+// hold queueMu.
+func queued(uuid string) int {
+	for n, job := range queue {
+		if job.Server == uuid {
+			return n
+		}
+	}
+
+	return -1
+}
+
+// dispatch starts the installs at the front of the queue while there are
+// free slots. The caller must hold queueMu.
+func dispatch() {
+	limit := config.Get().Install.Concurrency
+	if limit < 1 {
+		limit = 1
+	}
+
+	for len(active) < limit && len(queue) > 0 {
+		job := queue[0]
+		queue = queue[1:]
+
+		s, err := GetServer(job.Server)
+		if err != nil {
+			log.WithField("server", job.Server).Warn("dropping the install of a server that no longer exists")
+			continue
+		}
+
+		active[job.Server] = job
+		s.Go("install", func() {
+			runInstall(s, job)
+		})
+	}
+
+	if err := saveQueue(); err != nil {
+		log.WithError(err).Warn("failed to save the install queue")
+	}
+}
+
+func runInstall(s *Server, job installJob) {
+	defer func() {
+		queueMu.Lock()
+		delete(active, job.Server)
+		dispatch()
+		publishPositions()
+		queueMu.Unlock()
+	}()
+
+	cli, err := env.GetDocker()
+	i := &InstallProcess{
+		Server: s,
+		client: cli,
+	}
+	if err != nil {
+		i.failed(err)
+		return
+	}
+
+	if err := i.installServer(job.Reinstall); err != nil {
+		log.WithError(err).WithField("server", s.Uuid).Debug("install finished with an error")
+	}
+}
+
+// publishPositions tells every waiting server its position in the queue. The
+// caller must hold queueMu.
+func publishPositions() {
+	for n, job := range queue {
+		events.ForServer(job.Server, events.ServerInstallQueued, map[string]interface{}{
+			"server":   job.Server,
+			"position": n + 1,
+		}).Publish()
+	}
+}
+
+// saveQueue writes the running and the waiting installs to disk. The caller
+// must hold queueMu.
+func saveQueue() error {
+	jobs := make([]installJob, 0, len(active)+len(queue))
+	for _, job := range active {
+		jobs = append(jobs, job)
+	}
+	jobs = append(jobs, queue...)
+
+	b, err := json.MarshalIndent(jobs, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(queuePath(), b, 0644)
+}
+
+// resumeInstalls queues the installs that were running or waiting when the
+// daemon stopped. An install that was interrupted after it created a
+// container starts over as a reinstall, which removes that container first.
+func resumeInstalls() {
+	b, err := os.ReadFile(queuePath())
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.WithError(err).Error("failed to read the install queue")
+		return
+	}
+
+	var jobs []installJob
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		log.WithError(err).Error("failed to parse the install queue")
+		return
+	}
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	for _, job := range jobs {
+		s, err := GetServer(job.Server)
+		if err != nil || queued(s.Uuid) >= 0 {
+			continue
+		}
+
+		log.WithField("server", s.Uuid).Info("resuming an interrupted install")
+		queue = append(queue, installJob{Server: s.Uuid, Reinstall: job.Reinstall || s.DockerId != "", previous: s.State})
+		s.State = Queued
+	}
+
+	dispatch()
+	publishPositions()
+}
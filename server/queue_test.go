@@ -0,0 +1,66 @@
+package server
+
+import (
+	"daemon/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCancelQueuedInstall(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed bool
+		dockerId  string
+		reinstall bool
+	}{
+		{name: "install", installed: false, dockerId: "", reinstall: false},
+		{name: "reinstall", installed: true, dockerId: "container", reinstall: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			config.Get().Install.Concurrency = 1
+			if err := os.MkdirAll(filepath.Join(config.Get().System.DataDirectory, "servers"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			// another install takes the only slot, so the server has to wait.
+			queueMu.Lock()
+			active["other"] = installJob{Server: "other"}
+			queueMu.Unlock()
+			t.Cleanup(func() {
+				queueMu.Lock()
+				delete(active, "other")
+				queueMu.Unlock()
+			})
+
+			s.State = Stopped
+			s.Container.Installed = tt.installed
+			s.DockerId = tt.dockerId
+
+			if err := s.QueueInstall(tt.reinstall); err != nil {
+				t.Fatal(err)
+			}
+			if s.State != Queued || s.InstallPosition() != 1 {
+				t.Fatalf("the server is %s at position %d, want queued at 1", s.State, s.InstallPosition())
+			}
+
+			if err := s.CancelInstall(); err != nil {
+				t.Fatalf("CancelInstall() failed: %v", err)
+			}
+
+			if s.State != Stopped || s.InstallPosition() != 0 {
+				t.Fatalf("the server is %s at position %d, want stopped and not queued", s.State, s.InstallPosition())
+			}
+			if s.Container.Installed != tt.installed || s.DockerId != tt.dockerId || s.Container.InstallError != "" {
+				t.Fatalf("the cancelled install changed the server: installed %v, container %q, error %q", s.Container.Installed, s.DockerId, s.Container.InstallError)
+			}
+
+			if err := s.CancelInstall(); err != ErrNotInstalling {
+				t.Fatalf("CancelInstall() = %v, want ErrNotInstalling", err)
+			}
+		})
+	}
+}
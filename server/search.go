@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"daemon/config"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const snippetLength = 200
+
+var (
+	ErrInvalidSearch = errors.New("invalid search")
+
+	errSearchLimit = errors.New("search result limit reached")
+)
+
+type SearchMatch struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Snippet string `json:"snippet"`
+}
+
+// SearchFiles looks for pattern in the text files below directory. Only files
+// whose name or relative path match glob are searched when it is set. The
+// returned bool reports whether the results were cut off at the configured
+// limit. The search stops early when ctx is cancelled.
+func (s *Server) SearchFiles(ctx context.Context, directory string, pattern string, glob string, regex bool) ([]SearchMatch, bool, error) {
+	c := config.Get().Files.Search
+	if pattern == "" {
+		return nil, false, fmt.Errorf("%w: pattern is required", ErrInvalidSearch)
+	}
+
+	if !regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", ErrInvalidSearch, err.Error())
+	}
+
+	if glob != "" {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, false, fmt.Errorf("%w: %s", ErrInvalidSearch, err.Error())
+		}
+	}
+
+	root, err := s.resolvePath(directory)
+	if err != nil {
+		return nil, false, err
+	}
+	base := path.Clean("/" + strings.ReplaceAll(directory, "\\", "/"))
+
+	matches := []SearchMatch{}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		// entries that can't be read are left out, but the directory that is
+		// searched must exist.
+		if err != nil {
+			if p == root {
+				return err
+			}
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = path.Join(base, filepath.ToSlash(rel))
+
+		if glob != "" {
+			byName, _ := path.Match(glob, d.Name())
+			byPath, _ := path.Match(glob, strings.TrimPrefix(rel, "/"))
+			if !byName && !byPath {
+				return nil
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() > c.MaxFileSize {
+			return nil
+		}
+
+		return searchFile(p, rel, re, func(m SearchMatch) error {
+			if len(matches) >= c.MaxResults {
+				return errSearchLimit
+			}
+
+			matches = append(matches, m)
+			return nil
+		})
+	})
+
+	if errors.Is(err, errSearchLimit) {
+		return matches, true, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return matches, false, nil
+}
+
+func searchFile(p string, rel string, re *regexp.Regexp, fn func(SearchMatch) error) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	if bytes.IndexByte(head[:n], 0) != -1 {
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+
+		loc := re.FindStringIndex(text)
+		if loc == nil {
+			continue
+		}
+
+		if err := fn(SearchMatch{Path: rel, Line: line, Snippet: snippet(text, loc[0])}); err != nil {
+			return err
+		}
+	}
+
+	// the rest of a file with a line over the buffer size is skipped, like
+	// binary files are.
+	if err := scanner.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("failed to read %s: %w", rel, err)
+	}
+
+	return nil
+}
+
+// snippet returns the part of the line around the match, cut to at most
+// snippetLength bytes.
+func snippet(line string, at int) string {
+	if len(line) <= snippetLength {
+		return line
+	}
+
+	start := at - snippetLength/4
+	if start < 0 {
+		start = 0
+	}
+
+	end := start + snippetLength
+	if end > len(line) {
+		end = len(line)
+		start = end - snippetLength
+	}
+
+	return strings.ToValidUTF8(line[start:end], "")
+}
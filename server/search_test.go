@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"daemon/config"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func writeVolumeFiles(t *testing.T, s *Server, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(s.VolumePath(), filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchFiles(t *testing.T) {
+	s, _ := newTestServer(t)
+	writeVolumeFiles(t, s, map[string]string{
+		"server.properties":       "motd=A Minecraft Server\nserver-port=25565\n",
+		"config/paper.yml":        "settings:\n  max-players: 20\n",
+		"config/spigot.yml":       "settings:\n  debug: false\n",
+		"world/level.dat":         "server-port\x00binary",
+		"logs/latest.log":         "[INFO] Starting minecraft server on *:25565\n",
+		"plugins/Essentials.yml":  "# nothing here\n",
+		"plugins/empty/empty.txt": "",
+	})
+
+	tests := []struct {
+		name      string
+		directory string
+		pattern   string
+		glob      string
+		regex     bool
+		want      []string
+	}{
+		{name: "content", directory: "/", pattern: "25565", want: []string{"/logs/latest.log:1", "/server.properties:2"}},
+		{name: "case insensitive", directory: "/", pattern: "MINECRAFT", want: []string{"/logs/latest.log:1", "/server.properties:1"}},
+		{name: "below a directory", directory: "/config", pattern: "settings", want: []string{"/config/paper.yml:1", "/config/spigot.yml:1"}},
+		{name: "glob by name", directory: "/", pattern: "settings", glob: "paper.yml", want: []string{"/config/paper.yml:1"}},
+		{name: "glob by path", directory: "/", pattern: "25565", glob: "logs/*", want: []string{"/logs/latest.log:1"}},
+		{name: "regex", directory: "/", pattern: `max-\w+: \d+`, regex: true, want: []string{"/config/paper.yml:2"}},
+		{name: "pattern is quoted", directory: "/", pattern: `max-\w+`, want: []string{}},
+		{name: "binary files are skipped", directory: "/world", pattern: "server-port", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, truncated, err := s.SearchFiles(context.Background(), tt.directory, tt.pattern, tt.glob, tt.regex)
+			if err != nil {
+				t.Fatalf("SearchFiles() failed: %v", err)
+			}
+			if truncated {
+				t.Fatal("SearchFiles() reported the results as cut off")
+			}
+
+			got := []string{}
+			for _, m := range matches {
+				got = append(got, m.Path+":"+strconv.Itoa(m.Line))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("SearchFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchFilesLimit(t *testing.T) {
+	s, _ := newTestServer(t)
+	config.Get().Files.Search.MaxResults = 3
+	writeVolumeFiles(t, s, map[string]string{
+		"a.txt": "match\nmatch\n",
+		"b.txt": "match\nmatch\n",
+	})
+
+	matches, truncated, err := s.SearchFiles(context.Background(), "/", "match", "", false)
+	if err != nil {
+		t.Fatalf("SearchFiles() failed: %v", err)
+	}
+	if len(matches) != 3 || !truncated {
+		t.Fatalf("SearchFiles() returned %d matches, truncated %v, want 3 cut off", len(matches), truncated)
+	}
+}
+
+func TestSearchFilesErrors(t *testing.T) {
+	s, outside := newTestServer(t)
+	symlink(t, outside, filepath.Join(s.VolumePath(), "escape"))
+
+	tests := []struct {
+		name      string
+		directory string
+		pattern   string
+		glob      string
+		regex     bool
+		want      error
+	}{
+		{name: "no pattern", directory: "/", want: ErrInvalidSearch},
+		{name: "bad regex", directory: "/", pattern: "(", regex: true, want: ErrInvalidSearch},
+		{name: "bad glob", directory: "/", pattern: "x", glob: "[", want: ErrInvalidSearch},
+		{name: "outside of the volume", directory: "/escape", pattern: "x", want: ErrPathOutsideVolume},
+		{name: "missing directory", directory: "/missing", pattern: "x", want: os.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := s.SearchFiles(context.Background(), tt.directory, tt.pattern, tt.glob, tt.regex)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("SearchFiles() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchFilesSkipsUnreadable(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can read every directory")
+	}
+
+	s, _ := newTestServer(t)
+	writeVolumeFiles(t, s, map[string]string{
+		"readable.txt":        "match\n",
+		"locked/secret.txt":   "match\n",
+		"unreadable/file.txt": "match\n",
+	})
+	locked := filepath.Join(s.VolumePath(), "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(locked, 0755) })
+	if err := os.Chmod(filepath.Join(s.VolumePath(), "unreadable", "file.txt"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, _, err := s.SearchFiles(context.Background(), "/", "match", "", false)
+	if err != nil {
+		t.Fatalf("SearchFiles() failed on unreadable entries: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Path != "/readable.txt" {
+		t.Fatalf("SearchFiles() = %v, want only the readable file", matches)
+	}
+}
@@ -10,13 +10,13 @@ import (
 	"daemon/utils"
 	"encoding/json"
 	"errors"
-	"github.com/apex/log"
+	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
 	"github.com/google/uuid"
-	"io"
 	"os"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +30,10 @@ type Server struct {
 	Template  int       `json:"template"`
 	Container Container `json:"container"`
 
+	// TemplateVersion is the version of the template the server was
+	// installed with.
+	TemplateVersion int `json:"template_version"`
+
 	Resources   Resources        `json:"resources"`
 	Allocations *env.Allocations `json:"allocations"`
 
@@ -39,6 +43,8 @@ type Server struct {
 	State State `json:"state"`
 
 	Stdin types.HijackedResponse `json:"-"`
+
+	filesLock sync.Mutex
 }
 
 type Resources struct {
@@ -51,6 +57,7 @@ type Container struct {
 	StartupCommand string            `json:"startup_command"`
 	Image          string            `json:"image"`
 	Installed      bool              `json:"installed"`
+	InstallError   string            `json:"install_error,omitempty"`
 	Variables      map[string]string `json:"variables"`
 }
 
@@ -63,6 +70,7 @@ const (
 	Stopping
 	Installing
 	Unknown
+	Queued
 )
 
 var (
@@ -73,6 +81,7 @@ var (
 		Stopping:   "stopping",
 		Installing: "installing",
 		Unknown:    "unknown",
+		Queued:     "queued",
 	}
 	Servers []*Server
 )
@@ -81,20 +90,23 @@ func (s State) String() string {
 	return stateMap[s]
 }
 
-func Load(c *config.Config) {
+// Load reads the servers from the data directory and attaches to the ones
+// that are running.
+func Load(c *config.Config) error {
 	Servers = []*Server{}
 	data := utils.Normalize(c.System.DataDirectory + "/servers")
 	log.Debugf("loading servers from %s", data)
 
 	cli, err := env.GetDocker()
 	if err != nil {
-		log.WithError(err).Fatal("failed to get docker client")
-		return
+		return fmt.Errorf("%w: %s", ErrDockerUnavailable, err.Error())
 	}
 
+	go pruneTrashLoop()
+
 	b, err := os.ReadDir(data)
 	if err != nil {
-		return
+		return nil
 	}
 
 	for _, f := range b {
@@ -129,10 +141,15 @@ func Load(c *config.Config) {
 			} else {
 				s.Stdin = stdin
 			}
+
+			s.followConsole(time.Now())
 		}
 
 		Servers = append(Servers, &s)
 	}
+
+	resumeInstalls()
+	return nil
 }
 
 func GetServer(id string) (*Server, error) {
@@ -186,6 +203,16 @@ func CreateServer(name string, description string, template int, image string, s
 	resources Resources, allocations *env.Allocations, variables map[string]string) (*Server, error) {
 	c := *config.Get()
 
+	t, err := templates.GetTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	variables, err = t.ValidateVariables(variables)
+	if err != nil {
+		return nil, err
+	}
+
 	sUuid := uuid.New().String()
 	id := sUuid[:8]
 
@@ -210,7 +237,7 @@ func CreateServer(name string, description string, template int, image string, s
 	s.State = Stopped
 	Servers = append(Servers, s)
 
-	ev := events.New(events.ServerCreated, s)
+	ev := events.ForServer(s.Uuid, events.ServerCreated, s)
 	ev.Publish()
 
 	volumesPath := utils.Normalize(c.System.VolumesDirectory + "/" + s.Uuid)
@@ -236,12 +263,7 @@ func CreateServer(name string, description string, template int, image string, s
 		return nil, err
 	}
 
-	cl, _ := env.GetDocker()
-	i := &InstallProcess{
-		Server: s,
-		client: cl,
-	}
-	if err := i.installServer(false); err != nil {
+	if err := s.QueueInstall(false); err != nil {
 		return nil, err
 	}
 
@@ -264,35 +286,41 @@ func (s *Server) Save() error {
 	return nil
 }
 
-func (s *Server) tempInstallDir() string {
-	c := *config.Get()
-	dir := utils.Normalize(c.System.VolumesDirectory + "/install_" + s.Uuid)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.WithError(err).Fatal("failed to create temp install dir")
-			return ""
-		}
+// UpdateVariables changes the values of the given variables of the server,
+// after checking all its values against the rules of its template. They apply
+// from the next start, which recreates the container with them.
+func (s *Server) UpdateVariables(values map[string]string) error {
+	t, err := templates.GetTemplate(s.Template)
+	if err != nil {
+		return err
 	}
 
-	return dir
-}
-
-func (s *Server) Logs(follow bool) (io.ReadCloser, error) {
-	cli, _ := env.GetDocker()
-	ctx := context.Background()
+	merged := map[string]string{}
+	for k, v := range s.Container.Variables {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
 
-	reader, err := cli.ContainerLogs(ctx, s.DockerId, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     follow,
-		Since:      time.Now().Format(time.RFC3339),
-	})
+	variables, err := t.ValidateVariables(merged)
 	if err != nil {
-		log.WithError(err).Fatal("failed to get logs")
-		return nil, err
+		return err
+	}
+
+	s.Container.Variables = variables
+	s.UpdatedAt = time.Now().Unix()
+	return s.Save()
+}
+
+func (s *Server) tempInstallDir() (string, error) {
+	c := *config.Get()
+	dir := utils.Normalize(c.System.VolumesDirectory + "/install_" + s.Uuid)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create temp install dir: %w", err)
 	}
 
-	return reader, nil
+	return dir, nil
 }
 
 type PowerAction int
@@ -320,23 +348,19 @@ func (p PowerAction) String() string {
 }
 
 func (s *Server) Power(action PowerAction) error {
-	cli, _ := env.GetDocker()
+	cli, err := env.GetDocker()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrDockerUnavailable, err.Error())
+	}
 	ctx := context.Background()
 	t, err := templates.GetTemplate(s.Template)
 	if err != nil {
 		return err
 	}
 
-	var conf struct {
-		Started *string `json:"started"`
-	}
-	if err := json.Unmarshal([]byte(t.Docker.StartConfig), &conf); err != nil {
-		return err
-	}
-
 	log.Debugf("received power action: %s for server %s", action.String(), s.Uuid)
 
-	events.New(events.ServerLog, map[string]interface{}{
+	events.ForServer(s.Uuid, events.ServerLog, map[string]interface{}{
 		"message": "Received power action '" + action.String() + "' for server.",
 		"daemon":  true,
 	}).Publish()
@@ -344,45 +368,43 @@ func (s *Server) Power(action PowerAction) error {
 	switch action {
 	case PowerStart:
 		s.State = Starting
+		if err := s.recreateContainer(ctx, cli); err != nil {
+			return fmt.Errorf("failed to recreate container: %w", err)
+		}
+		s.applyConfigFiles(t)
+		started := time.Now()
 		if err := cli.ContainerStart(ctx, s.DockerId, container.StartOptions{}); err != nil {
 			return err
 		}
 
-		events.New(events.PowerEvent, map[string]interface{}{
+		events.ForServer(s.Uuid, events.PowerEvent, map[string]interface{}{
 			"action": action.String(),
 			"status": Starting.String(),
 		}).Publish()
 
-		attach, err := cli.ContainerAttach(ctx, s.DockerId, container.AttachOptions{
-			Stdin:  true,
-			Stdout: false,
-			Stderr: false,
-			Stream: true,
-		})
-		if err != nil {
-			log.WithError(err).Fatal("failed to attach to container")
+		if err := s.attachStdin(ctx, cli); err != nil {
 			return err
 		}
-		s.Stdin = attach
+		s.followConsole(started)
 	case PowerStop:
 		s.State = Stopping
-		events.New(events.PowerEvent, map[string]interface{}{
+		events.ForServer(s.Uuid, events.PowerEvent, map[string]interface{}{
 			"action": action.String(),
 			"status": Stopping.String(),
 		}).Publish()
-		go func() {
+		s.Go("stop", func() {
 			if t.Docker.StopCommand != "" {
 				cmd := t.Docker.StopCommand
 				if err := s.Command(cmd); err != nil {
 					log.WithError(err).Error("failed to send stop command to server")
-					events.New(events.ServerLog, map[string]interface{}{
+					events.ForServer(s.Uuid, events.ServerLog, map[string]interface{}{
 						"message": "\u001b[41mERROR: Unable to send power action 'stop' to server. " + err.Error(),
 						"daemon":  false,
 					}).Publish()
 					return
 				}
 
-				events.New(events.ServerLog, map[string]interface{}{
+				events.ForServer(s.Uuid, events.ServerLog, map[string]interface{}{
 					"message": cmd,
 					"daemon":  false,
 				}).Publish()
@@ -394,93 +416,55 @@ func (s *Server) Power(action PowerAction) error {
 			select {
 			case err := <-eChan:
 				if err != nil {
-					log.WithError(err).Fatal("failed to wait for container")
+					s.ReportError(fmt.Errorf("failed to wait for the container to stop: %w", err))
 				}
 			case <-wChan:
 				s.State = Stopped
-				events.New(events.PowerEvent, map[string]interface{}{
+				events.ForServer(s.Uuid, events.PowerEvent, map[string]interface{}{
 					"action": action.String(),
 					"status": Stopped.String(),
 				}).Publish()
 				if err := s.Save(); err != nil {
-					log.WithError(err).Fatal("failed to save server")
+					s.ReportError(fmt.Errorf("failed to save server: %w", err))
 				}
 			}
-		}()
+		})
 
-		if err := cli.ContainerStop(ctx, s.DockerId, container.StopOptions{}); err != nil {
+		timeout := config.Get().Docker.StopTimeout
+		if err := cli.ContainerStop(ctx, s.DockerId, container.StopOptions{Timeout: &timeout}); err != nil {
 			return err
 		}
 	case PowerRestart:
-		wChan, eChan := cli.ContainerWait(ctx, s.DockerId, container.WaitConditionNotRunning)
-		select {
-		case err := <-eChan:
-			if err != nil {
-				log.WithError(err).Fatal("failed to wait for container")
-			}
-		case <-wChan:
-			s.State = Starting
-			events.New(events.PowerEvent, map[string]interface{}{
-				"action": action.String(),
-				"status": Starting.String(),
-			}).Publish()
-			if err := s.Save(); err != nil {
-				log.WithError(err).Fatal("failed to save server")
-			}
+		if err := s.stopContainer(ctx, cli); err != nil {
+			return err
 		}
 
-		go func() {
-			if conf.Started == nil {
-				return
-			}
-
-			r, err := s.Logs(true)
-			if err != nil {
-				log.WithError(err).Fatal("failed to get logs")
-				return
-			}
-
-			// read lines and check for started message
-			defer func() {
-				if err := r.Close(); err != nil {
-					log.WithError(err).Fatal("failed to close reader")
-				}
-			}()
-
-			for {
-				buf := make([]byte, 1024)
-				n, err := r.Read(buf)
-				if err != nil {
-					log.WithError(err).Fatal("failed to read logs")
-					return
-				}
-
-				if strings.Contains(string(buf[:n]), *conf.Started) {
-					s.State = Running
-					events.New(events.PowerEvent, map[string]interface{}{
-						"action": action.String(),
-						"status": Running.String(),
-					})
-					err := r.Close()
-					if err != nil {
-						log.WithError(err).Fatal("failed to close reader")
-					}
-
-					err = s.Save()
-					if err != nil {
-						log.WithError(err).Fatal("failed to save server")
-					}
-					break
-				}
-			}
-		}()
+		s.State = Starting
+		events.ForServer(s.Uuid, events.PowerEvent, map[string]interface{}{
+			"action": action.String(),
+			"status": Starting.String(),
+		}).Publish()
+		if err := s.Save(); err != nil {
+			return fmt.Errorf("failed to save server: %w", err)
+		}
 
-		if err := cli.ContainerRestart(ctx, s.DockerId, container.StopOptions{}); err != nil {
+		// the console pipeline marks the server as running once the
+		// started message of the template is printed.
+		if err := s.recreateContainer(ctx, cli); err != nil {
+			return fmt.Errorf("failed to recreate container: %w", err)
+		}
+		s.applyConfigFiles(t)
+		restarted := time.Now()
+		if err := cli.ContainerStart(ctx, s.DockerId, container.StartOptions{}); err != nil {
 			return err
 		}
+		if err := s.attachStdin(ctx, cli); err != nil {
+			return err
+		}
+		s.followConsole(restarted)
 	case PowerKill:
 		if s.State != Stopping {
-			return errors.New("server is not stopping, cannot kill")
+			return ErrServerNotStopping
 		}
 
 		if err := cli.ContainerKill(ctx, s.DockerId, "KILL"); err != nil {
@@ -489,19 +473,63 @@ func (s *Server) Power(action PowerAction) error {
 		}
 
 		s.State = Stopped
-		events.New(events.PowerEvent, map[string]interface{}{
+		events.ForServer(s.Uuid, events.PowerEvent, map[string]interface{}{
 			"action": action.String(),
 			"status": Stopped.String(),
 		}).Publish()
 		if err := s.Save(); err != nil {
-			log.WithError(err).Fatal("failed to save server")
+			return fmt.Errorf("failed to save server: %w", err)
 		}
+	}
 
+	return nil
+}
+
+// stopContainer stops the server container and waits until it is no longer
+// running. Docker kills it when it doesn't stop within the stop timeout, and
+// the wait gives up a while after that, so a restart can't hang.
+func (s *Server) stopContainer(ctx context.Context, cli *client.Client) error {
+	timeout := config.Get().Docker.StopTimeout
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second+30*time.Second)
+	defer cancel()
+
+	if err := cli.ContainerStop(ctx, s.DockerId, container.StopOptions{Timeout: &timeout}); err != nil {
+		if client.IsErrNotFound(err) {
+			// the container is recreated anyway.
+			return nil
+		}
+		return fmt.Errorf("failed to stop container: %w", err)
+	}
+
+	wChan, eChan := cli.ContainerWait(ctx, s.DockerId, container.WaitConditionNotRunning)
+	select {
+	case err := <-eChan:
+		if err != nil && !client.IsErrNotFound(err) {
+			return fmt.Errorf("failed to wait for container: %w", err)
+		}
+	case <-wChan:
 	}
 
 	return nil
 }
 
+// attachStdin attaches to the input of the server container, which commands
+// are written to.
+func (s *Server) attachStdin(ctx context.Context, cli *client.Client) error {
+	attach, err := cli.ContainerAttach(ctx, s.DockerId, container.AttachOptions{
+		Stdin:  true,
+		Stdout: false,
+		Stderr: false,
+		Stream: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach to container: %w", err)
+	}
+
+	s.Stdin = attach
+	return nil
+}
+
 func (s *Server) GetStats() (map[string]interface{}, error) {
 	cli, _ := env.GetDocker()
 	ctx := context.Background()
@@ -602,6 +630,10 @@ func (s *Server) GetLogsSinceStart() ([]string, error) {
 }
 
 func (s *Server) Command(command string) error {
+	if s.Stdin.Conn == nil {
+		return ErrServerNotRunning
+	}
+
 	_, err := s.Stdin.Conn.Write([]byte(command + "\n"))
 	return err
 }
@@ -617,8 +649,20 @@ func (s *Server) Delete(delVolumes bool) error {
 				return err
 			}
 		}
+
+		if err := os.RemoveAll(s.trashDir()); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(s.consoleLogDir()); err != nil {
+		return err
 	}
 
+	consolesMu.Lock()
+	delete(consoles, s.Uuid)
+	consolesMu.Unlock()
+
 	if err := os.Remove(data + "/" + s.Uuid + ".json"); err != nil {
 		return err
 	}
@@ -630,6 +674,6 @@ func (s *Server) Delete(delVolumes bool) error {
 		}
 	}
 
-	events.New(events.ServerDeleted, s.Id).Publish()
+	events.ForServer(s.Uuid, events.ServerDeleted, s.Id).Publish()
 	return nil
 }
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"daemon/templates"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	startupPlaceholder = regexp.MustCompile(`{{\s*([A-Za-z0-9_.]+)\s*}}`)
+	shellSafe          = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+	// doubleQuoteEscaper escapes the characters that are still special
+	// between double quotes.
+	doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+)
+
+// quoting is the kind of shell quotes a position of a command is in.
+type quoting int
+
+const (
+	unquoted quoting = iota
+	singleQuoted
+	doubleQuoted
+)
+
+// StartupVariables returns the values the placeholders of the startup command
+// are replaced with: the variables of the server, its resources, its default
+// allocation and its uuid.
+func (s *Server) StartupVariables() map[string]string {
+	vars := map[string]string{}
+	for k, v := range s.Container.Variables {
+		vars[k] = v
+	}
+
+	vars["SERVER_MEMORY"] = strconv.FormatInt(s.Resources.Memory/1024/1024, 10)
+	vars["SERVER_DISK"] = strconv.FormatInt(s.Resources.Disk/1024/1024, 10)
+	vars["SERVER_CPU"] = strconv.FormatInt(s.Resources.Cpu, 10)
+	vars["SERVER_UUID"] = s.Uuid
+	if s.Allocations != nil {
+		vars["SERVER_IP"] = s.Allocations.DefaultMapping.Ip
+		vars["SERVER_PORT"] = strconv.Itoa(s.Allocations.DefaultMapping.Port)
+	}
+
+	return vars
+}
+
+// StartupCommand returns the startup command of the server before it is
+// rendered, falling back to the one of its template.
+func (s *Server) StartupCommand() string {
+	if s.Container.StartupCommand != "" {
+		return s.Container.StartupCommand
+	}
+
+	t, err := templates.GetTemplate(s.Template)
+	if err != nil {
+		return ""
+	}
+
+	return t.Docker.StartCommand
+}
+
+// RenderStartup replaces the {{NAME}} placeholders of the startup command with
+// their values, quoted for the shell so they stay a single word. Values of
+// placeholders that are already between quotes in the command are escaped for
+// those quotes instead. Placeholders without a value are left as they are.
+func (s *Server) RenderStartup() string {
+	vars := s.StartupVariables()
+	command := s.StartupCommand()
+
+	var b strings.Builder
+	state := unquoted
+	last := 0
+	for _, loc := range startupPlaceholder.FindAllStringSubmatchIndex(command, -1) {
+		state = scanQuotes(command[last:loc[0]], state)
+		b.WriteString(command[last:loc[0]])
+		last = loc[1]
+
+		v, ok := vars[command[loc[2]:loc[3]]]
+		if !ok {
+			b.WriteString(command[loc[0]:loc[1]])
+			continue
+		}
+
+		switch state {
+		case singleQuoted:
+			b.WriteString(strings.ReplaceAll(v, "'", `'"'"'`))
+		case doubleQuoted:
+			b.WriteString(doubleQuoteEscaper.Replace(v))
+		default:
+			b.WriteString(shellQuote(v))
+		}
+	}
+	b.WriteString(command[last:])
+
+	return b.String()
+}
+
+// scanQuotes returns the quoting at the end of text, when it starts with the
+// given one.
+func scanQuotes(text string, state quoting) quoting {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case state == singleQuoted:
+			if c == '\'' {
+				state = unquoted
+			}
+		case c == '\\':
+			// the next character is escaped.
+			i++
+		case c == '"' && state == doubleQuoted:
+			state = unquoted
+		case c == '"':
+			state = doubleQuoted
+		case c == '\'' && state == unquoted:
+			state = singleQuoted
+		}
+	}
+
+	return state
+}
+
+// StartupCmd returns the entrypoint and the command the server container runs
+// its rendered startup command with.
+func (s *Server) StartupCmd() ([]string, []string) {
+	return []string{"/bin/sh", "-c"}, []string{s.RenderStartup()}
+}
+
+func shellQuote(v string) string {
+	if v == "" {
+		return "''"
+	}
+
+	if shellSafe.MatchString(v) {
+		return v
+	}
+
+	return "'" + strings.ReplaceAll(v, "'", `'"'"'`) + "'"
+}
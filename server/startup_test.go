@@ -0,0 +1,88 @@
+package server
+
+import (
+	"daemon/config"
+	"daemon/env"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestRuntimeConfigRendersCurrentValues(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Allocations = &env.Allocations{}
+	s.Allocations.DefaultMapping.Ip = "0.0.0.0"
+	s.Allocations.DefaultMapping.Port = 25565
+	s.Container.StartupCommand = "java -Xmx{{SERVER_MEMORY}}M -jar {{SERVER_JAR}} --port {{SERVER_PORT}}"
+	s.Container.Variables = map[string]string{"SERVER_JAR": "server.jar"}
+	s.Resources.Memory = 1024 * 1024 * 1024
+
+	_, hostConfig := s.runtimeConfig(*config.Get(), "bridge")
+	if hostConfig.Resources.Memory != s.Resources.Memory {
+		t.Fatalf("memory limit = %d, want %d", hostConfig.Resources.Memory, s.Resources.Memory)
+	}
+
+	// changes made after the install apply to the next container.
+	s.Container.Variables["SERVER_JAR"] = "paper.jar"
+	s.Resources.Memory = 2 * 1024 * 1024 * 1024
+	s.Allocations.DefaultMapping.Port = 25566
+
+	containerConfig, hostConfig := s.runtimeConfig(*config.Get(), "bridge")
+	want := "java -Xmx2048M -jar paper.jar --port 25566"
+	if len(containerConfig.Cmd) != 1 || containerConfig.Cmd[0] != want {
+		t.Fatalf("cmd = %q, want %q", containerConfig.Cmd, want)
+	}
+	if !slices.Equal(containerConfig.Entrypoint, []string{"/bin/sh", "-c"}) {
+		t.Fatalf("entrypoint = %q", containerConfig.Entrypoint)
+	}
+	if !slices.Contains(containerConfig.Env, "SERVER_JAR=paper.jar") || !slices.Contains(containerConfig.Env, "PORT=25566") {
+		t.Fatalf("env = %q", containerConfig.Env)
+	}
+	if hostConfig.Resources.Memory != s.Resources.Memory {
+		t.Fatalf("memory limit = %d, want %d", hostConfig.Resources.Memory, s.Resources.Memory)
+	}
+	if containerConfig.Cmd[0] != s.RenderStartup() {
+		t.Fatalf("the container runs %q, but the startup preview is %q", containerConfig.Cmd[0], s.RenderStartup())
+	}
+}
+
+func TestRenderStartupQuoting(t *testing.T) {
+	s, _ := newTestServer(t)
+	value := `it's "$HOME" \ $(id) ` + "`id`"
+	s.Container.Variables = map[string]string{"MOTD": value}
+
+	tests := []struct {
+		name    string
+		command string
+		// want is the rendered command, when it is checked.
+		want string
+		// printed is what the rendered command prints.
+		printed string
+	}{
+		{name: "unquoted", command: `printf %s {{MOTD}}`, want: `printf %s 'it'"'"'s "$HOME" \ $(id) ` + "`id`'", printed: value},
+		{name: "double quoted", command: `printf %s "{{MOTD}}"`, want: `printf %s "it's \"\$HOME\" \\ \$(id) ` + "\\`id\\`\"", printed: value},
+		{name: "single quoted", command: `printf %s '{{MOTD}}'`, want: `printf %s 'it'"'"'s "$HOME" \ $(id) ` + "`id`'", printed: value},
+		{name: "inside a double quoted word", command: `printf %s "motd={{MOTD}}"`, printed: "motd=" + value},
+		{name: "after an escaped quote", command: `printf %s \"{{MOTD}}\"`, printed: `"` + value + `"`},
+		{name: "single quotes inside double quotes", command: `printf %s "'{{MOTD}}'"`, printed: "'" + value + "'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Container.StartupCommand = tt.command
+			rendered := s.RenderStartup()
+			if tt.want != "" && rendered != tt.want {
+				t.Fatalf("RenderStartup() = %s, want %s", rendered, tt.want)
+			}
+
+			// the shell must see the value as it is, without running any of it.
+			out, err := exec.Command("/bin/sh", "-c", rendered).Output()
+			if err != nil {
+				t.Fatalf("running %s failed: %v", rendered, err)
+			}
+			if string(out) != tt.printed {
+				t.Fatalf("%s printed %q, want %q", rendered, out, tt.printed)
+			}
+		})
+	}
+}
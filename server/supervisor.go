@@ -0,0 +1,42 @@
+package server
+
+import (
+	"daemon/events"
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+var (
+	ErrDockerUnavailable = errors.New("docker is unavailable")
+	ErrServerNotRunning  = errors.New("server is not running")
+	ErrServerNotStopping = errors.New("server is not stopping, cannot kill")
+)
+
+// Go runs fn in a goroutine supervised for the server. A panic in it is
+// recovered and reported as an error of the server, instead of taking down
+// the daemon and every other server with it.
+func (s *Server) Go(name string, fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.WithField("server", s.Uuid).WithField("stack", string(debug.Stack())).
+					Errorf("recovered from a panic in %s", name)
+				s.ReportError(fmt.Errorf("%s failed unexpectedly: %v", name, r))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// ReportError logs an error of the server that happened outside of a request,
+// and publishes it so the websocket clients of the server are told about it.
+func (s *Server) ReportError(err error) {
+	log.WithError(err).WithField("server", s.Uuid).Error("server error")
+
+	events.ForServer(s.Uuid, events.ServerError, map[string]interface{}{
+		"server": s.Uuid,
+		"error":  err.Error(),
+	}).Publish()
+}
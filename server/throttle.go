@@ -0,0 +1,92 @@
+package server
+
+import (
+	"daemon/config"
+	"strconv"
+	"time"
+)
+
+// throttle counts the console output of a server per second, and drops what
+// goes over the configured limits.
+type throttle struct {
+	config config.ThrottleConfig
+
+	window time.Time
+	lines  int
+	bytes  int64
+
+	suppressed      int
+	suppressedBytes int64
+	violated        bool
+
+	violations    int
+	lastViolation time.Time
+}
+
+func newThrottle(c config.ThrottleConfig) *throttle {
+	return &throttle{config: c}
+}
+
+// allow reports whether a line read at now passes the limits. It also returns
+// the notices to send to the console, and whether the server should be
+// stopped for exceeding the limits too often.
+func (t *throttle) allow(line string, now time.Time) (bool, []string, bool) {
+	if !t.config.Enabled {
+		return true, nil, false
+	}
+
+	var notices []string
+	if now.Sub(t.window) >= time.Second {
+		if notice := t.summary(); notice != "" {
+			notices = append(notices, notice)
+		}
+
+		t.window = now
+		t.lines = 0
+		t.bytes = 0
+		t.violated = false
+	}
+
+	t.lines++
+	t.bytes += int64(len(line))
+	overLines := t.config.Lines > 0 && t.lines > t.config.Lines
+	overBytes := t.config.Bytes > 0 && t.bytes > t.config.Bytes
+	if !overLines && !overBytes {
+		return true, notices, false
+	}
+
+	t.suppressed++
+	t.suppressedBytes += int64(len(line))
+	if t.violated {
+		return false, notices, false
+	}
+	t.violated = true
+
+	if now.Sub(t.lastViolation) > time.Duration(t.config.Cooldown)*time.Second {
+		t.violations = 0
+	}
+	t.violations++
+	t.lastViolation = now
+
+	notices = append(notices, "Server is sending too much console output, output is being throttled")
+	if t.config.StopAfter > 0 && t.violations >= t.config.StopAfter {
+		t.violations = 0
+		return false, notices, true
+	}
+
+	return false, notices, false
+}
+
+// summary returns a notice about the output dropped in the last window, if
+// there was any, and resets the count.
+func (t *throttle) summary() string {
+	if t.suppressed == 0 {
+		return ""
+	}
+
+	notice := strconv.Itoa(t.suppressed) + " console lines (" + strconv.FormatInt(t.suppressedBytes, 10) +
+		" bytes) were suppressed by the output throttle"
+	t.suppressed = 0
+	t.suppressedBytes = 0
+	return notice
+}
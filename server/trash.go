@@ -0,0 +1,308 @@
+package server
+
+import (
+	"daemon/config"
+	"daemon/utils"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTrashItemNotFound = errors.New("trash item not found")
+	ErrFileExists        = errors.New("a file already exists at the target path")
+)
+
+type TrashItem struct {
+	Id        string `json:"id"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	IsDir     bool   `json:"is_dir"`
+	DeletedAt int64  `json:"deleted_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (s *Server) trashDir() string {
+	c := config.Get()
+	return utils.Normalize(c.System.VolumesDirectory + "/trash_" + s.Uuid)
+}
+
+// DeleteFile removes a file or directory from the server volume. If the
+// recycle bin is enabled and the content fits in it, it is moved there so it
+// can be restored later, otherwise it is removed permanently.
+func (s *Server) DeleteFile(p string) error {
+	c := config.Get().Files.Trash
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	if p == "/" {
+		return errors.New("the root directory of a server cannot be deleted")
+	}
+
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	// the entry itself isn't followed, so a symlink is deleted, not its
+	// target.
+	parent, err := s.resolvePath(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	absPath := filepath.Join(parent, path.Base(p))
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return err
+	}
+
+	size, err := dirSize(absPath)
+	if err != nil {
+		return err
+	}
+
+	if !c.Enabled || (c.MaxSize > 0 && size > c.MaxSize) {
+		return os.RemoveAll(absPath)
+	}
+
+	if err := s.pruneTrash(size); err != nil {
+		return err
+	}
+
+	dir := s.trashDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	item := TrashItem{
+		Id:        uuid.New().String(),
+		Path:      p,
+		Size:      size,
+		IsDir:     info.IsDir(),
+		DeletedAt: now.Unix(),
+		ExpiresAt: now.Add(time.Duration(c.Retention) * time.Hour).Unix(),
+	}
+
+	b, err := json.MarshalIndent(item, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, item.Id+".json"), b, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(absPath, filepath.Join(dir, item.Id)); err != nil {
+		_ = os.Remove(filepath.Join(dir, item.Id+".json"))
+		return err
+	}
+
+	return nil
+}
+
+// ListTrash returns the items in the recycle bin of the server, the most
+// recently deleted first.
+func (s *Server) ListTrash() ([]TrashItem, error) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	if err := s.pruneTrash(0); err != nil {
+		return nil, err
+	}
+
+	items, err := s.trashItems()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt > items[j].DeletedAt
+	})
+
+	return items, nil
+}
+
+// RestoreTrash moves an item from the recycle bin back into the volume, to
+// target if set or to the path it was deleted from otherwise.
+func (s *Server) RestoreTrash(id string, target string) (*TrashItem, error) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	item, err := s.trashItem(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if target == "" {
+		target = item.Path
+	}
+
+	target = path.Clean("/" + strings.ReplaceAll(target, "\\", "/"))
+	if target == "/" {
+		return nil, ErrFileExists
+	}
+
+	absPath, err := s.resolvePath(target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(absPath); err == nil {
+		return nil, ErrFileExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return nil, err
+	}
+
+	dir := s.trashDir()
+	if err := os.Rename(filepath.Join(dir, item.Id), absPath); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(filepath.Join(dir, item.Id+".json")); err != nil {
+		log.WithError(err).WithField("server", s.Uuid).Warn("failed to remove trash item metadata")
+	}
+
+	item.Path = target
+	return item, nil
+}
+
+// PurgeTrash permanently removes an item from the recycle bin, or every item
+// if id is empty.
+func (s *Server) PurgeTrash(id string) error {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	if id == "" {
+		return os.RemoveAll(s.trashDir())
+	}
+
+	item, err := s.trashItem(id)
+	if err != nil {
+		return err
+	}
+
+	return s.removeTrashItem(*item)
+}
+
+// TrashUsage returns the total size in bytes of the recycle bin.
+func (s *Server) TrashUsage() (int64, error) {
+	size, err := dirSize(s.trashDir())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	return size, err
+}
+
+// pruneTrash removes expired items from the recycle bin, then removes the
+// oldest items until extra more bytes fit within the configured size.
+func (s *Server) pruneTrash(extra int64) error {
+	c := config.Get().Files.Trash
+
+	items, err := s.trashItems()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt < items[j].DeletedAt
+	})
+
+	now := time.Now().Unix()
+	var total int64
+	for _, item := range items {
+		total += item.Size
+	}
+
+	for _, item := range items {
+		if item.ExpiresAt > now && (c.MaxSize <= 0 || total+extra <= c.MaxSize) {
+			continue
+		}
+
+		if err := s.removeTrashItem(item); err != nil {
+			return err
+		}
+		total -= item.Size
+	}
+
+	return nil
+}
+
+func (s *Server) trashItems() ([]TrashItem, error) {
+	dir := s.trashDir()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []TrashItem{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	items := []TrashItem{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var item TrashItem
+		if err := json.Unmarshal(b, &item); err != nil {
+			log.WithError(err).WithField("server", s.Uuid).Warnf("failed to read trash item %s", e.Name())
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (s *Server) trashItem(id string) (*TrashItem, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrTrashItemNotFound
+	}
+
+	b, err := os.ReadFile(filepath.Join(s.trashDir(), id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrTrashItemNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var item TrashItem
+	if err := json.Unmarshal(b, &item); err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+func (s *Server) removeTrashItem(item TrashItem) error {
+	dir := s.trashDir()
+	if err := os.RemoveAll(filepath.Join(dir, item.Id)); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(dir, item.Id+".json"))
+}
+
+// pruneTrashLoop periodically removes expired items from the recycle bins of
+// all servers.
+func pruneTrashLoop() {
+	for range time.Tick(time.Hour) {
+		for _, s := range Servers {
+			s.filesLock.Lock()
+			if err := s.pruneTrash(0); err != nil {
+				log.WithError(err).WithField("server", s.Uuid).Error("failed to prune trash")
+			}
+			s.filesLock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"daemon/config"
+	"daemon/utils"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWatchLimit       = errors.New("too many directories are being watched for this server")
+	ErrWatchUnsupported = utils.ErrWatchUnsupported
+
+	watchesMu sync.Mutex
+	watches   = map[string]map[string]*dirWatch{}
+)
+
+type FileChange struct {
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+}
+
+type dirWatch struct {
+	sync.Mutex
+	server    *Server
+	directory string
+	backend   utils.DirWatcher
+
+	nextId      int
+	subscribers map[int]func([]FileChange)
+
+	pending []utils.WatchEvent
+	timer   *time.Timer
+}
+
+// WatchDirectory calls fn with batches of changes made to the entries of a
+// directory in the server volume. Subscribers of the same directory share a
+// single watcher, which is stopped once the last of them unsubscribes by
+// calling the returned function.
+func (s *Server) WatchDirectory(directory string, fn func([]FileChange)) (func(), error) {
+	c := config.Get().Files.Watch
+	directory = path.Clean("/" + strings.ReplaceAll(directory, "\\", "/"))
+
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+
+	dirs := watches[s.Uuid]
+	if dirs == nil {
+		dirs = map[string]*dirWatch{}
+		watches[s.Uuid] = dirs
+	}
+
+	w, ok := dirs[directory]
+	if !ok {
+		if c.MaxWatches > 0 && len(dirs) >= c.MaxWatches {
+			return nil, ErrWatchLimit
+		}
+
+		absPath, err := s.resolvePath(directory)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(absPath); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, errors.New("path is not a directory: " + directory)
+		}
+
+		backend, err := utils.WatchDir(absPath)
+		if err != nil {
+			return nil, err
+		}
+
+		w = &dirWatch{
+			server:      s,
+			directory:   directory,
+			backend:     backend,
+			subscribers: map[int]func([]FileChange){},
+		}
+		dirs[directory] = w
+
+		go w.run()
+	}
+
+	w.Lock()
+	id := w.nextId
+	w.nextId++
+	w.subscribers[id] = fn
+	w.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.unsubscribe(id)
+		})
+	}, nil
+}
+
+func (w *dirWatch) run() {
+	if err := w.backend.Read(w.handle); err != nil {
+		log.WithError(err).WithField("server", w.server.Uuid).Error("failed to watch directory")
+	}
+}
+
+func (w *dirWatch) handle(change utils.WatchEvent) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.pending = append(w.pending, change)
+	if w.timer == nil {
+		debounce := time.Duration(config.Get().Files.Watch.Debounce) * time.Millisecond
+		w.timer = time.AfterFunc(debounce, w.flush)
+	}
+
+	if change.Op == utils.WatchGone {
+		go w.stop()
+	}
+}
+
+func (w *dirWatch) flush() {
+	w.Lock()
+	changes := coalesce(w.directory, w.pending)
+	w.pending = nil
+	w.timer = nil
+
+	subscribers := make([]func([]FileChange), 0, len(w.subscribers))
+	for _, fn := range w.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	w.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, fn := range subscribers {
+		fn(changes)
+	}
+}
+
+// unsubscribe removes a subscriber, and stops the watch when it was the last
+// one. Emptiness is decided while holding watchesMu, so a concurrent
+// WatchDirectory can't subscribe to a watch that is being stopped.
+func (w *dirWatch) unsubscribe(id int) {
+	watchesMu.Lock()
+	w.Lock()
+	delete(w.subscribers, id)
+	removed := len(w.subscribers) == 0 && w.remove()
+	w.Unlock()
+	watchesMu.Unlock()
+
+	if removed {
+		w.close()
+	}
+}
+
+func (w *dirWatch) stop() {
+	watchesMu.Lock()
+	removed := w.remove()
+	watchesMu.Unlock()
+
+	if removed {
+		w.close()
+	}
+}
+
+// remove takes the watch from watches, and reports whether it was still in
+// there. The caller must hold watchesMu.
+func (w *dirWatch) remove() bool {
+	dirs := watches[w.server.Uuid]
+	if dirs[w.directory] != w {
+		return false
+	}
+
+	delete(dirs, w.directory)
+	if len(dirs) == 0 {
+		delete(watches, w.server.Uuid)
+	}
+	return true
+}
+
+func (w *dirWatch) close() {
+	if err := w.backend.Close(); err != nil {
+		log.WithError(err).WithField("server", w.server.Uuid).Warn("failed to close directory watcher")
+	}
+}
+
+// coalesce turns the raw changes of a debounce window into one change per
+// entry. Moves within the directory are paired into renames by their cookie,
+// and a file that is created and then renamed over another one, as done by
+// atomic writes, is reported as a modification of the target.
+func coalesce(directory string, raw []utils.WatchEvent) []FileChange {
+	type entry struct {
+		op      string
+		oldPath string
+	}
+
+	order := []string{}
+	entries := map[string]*entry{}
+	set := func(p string, op string, oldPath string) {
+		e, ok := entries[p]
+		if !ok {
+			order = append(order, p)
+			entries[p] = &entry{op: op, oldPath: oldPath}
+			return
+		}
+
+		switch {
+		case op == "modify" && (e.op == "create" || e.op == "rename"):
+		case op == "delete" && e.op == "create":
+			delete(entries, p)
+		case op == "delete" && e.op == "rename":
+			delete(entries, p)
+			entries[e.oldPath] = &entry{op: "delete"}
+			order = append(order, e.oldPath)
+		default:
+			e.op = op
+			e.oldPath = oldPath
+		}
+	}
+
+	moves := map[uint32]string{}
+	for _, c := range raw {
+		p := path.Join(directory, c.Name)
+		switch c.Op {
+		case utils.WatchCreate:
+			set(p, "create", "")
+		case utils.WatchModify:
+			set(p, "modify", "")
+		case utils.WatchDelete:
+			set(p, "delete", "")
+		case utils.WatchMovedFrom:
+			moves[c.Cookie] = p
+		case utils.WatchMovedTo:
+			from, ok := moves[c.Cookie]
+			if !ok {
+				set(p, "create", "")
+				continue
+			}
+			delete(moves, c.Cookie)
+
+			e, ok := entries[from]
+			delete(entries, from)
+			switch {
+			case !ok || e.op == "modify":
+				set(p, "rename", from)
+			case e.op == "create":
+				set(p, "modify", "")
+			case e.op == "rename":
+				set(p, "rename", e.oldPath)
+			}
+		case utils.WatchGone:
+			set(directory, "delete", "")
+		case utils.WatchOverflow:
+			// the client has to list the directory again.
+			set(directory, "rescan", "")
+		}
+	}
+
+	for _, p := range moves {
+		set(p, "delete", "")
+	}
+
+	changes := []FileChange{}
+	for _, p := range order {
+		if e, ok := entries[p]; ok {
+			changes = append(changes, FileChange{Type: e.op, Path: p, OldPath: e.oldPath})
+			delete(entries, p)
+		}
+	}
+
+	return changes
+}
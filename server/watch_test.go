@@ -0,0 +1,75 @@
+package server
+
+import (
+	"daemon/utils"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestUnsubscribeWhileSubscribing(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	unsubscribe, err := s.WatchDirectory("/", func([]FileChange) {})
+	if errors.Is(err, ErrWatchUnsupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func(unsubscribe func()) {
+			defer wg.Done()
+			unsubscribe()
+		}(unsubscribe)
+
+		unsubscribe, err = s.WatchDirectory("/", func([]FileChange) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		// the subscriber that is left must be on a watch that wasn't stopped.
+		watchesMu.Lock()
+		w := watches[s.Uuid]["/"]
+		watchesMu.Unlock()
+		if w == nil {
+			t.Fatalf("iteration %d: the watch of a subscribed directory was stopped", i)
+		}
+		w.Lock()
+		n := len(w.subscribers)
+		w.Unlock()
+		if n != 1 {
+			t.Fatalf("iteration %d: the watch has %d subscribers, want 1", i, n)
+		}
+	}
+
+	unsubscribe()
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+	if _, ok := watches[s.Uuid]; ok {
+		t.Fatal("the watch wasn't stopped after the last subscriber left")
+	}
+}
+
+func TestCoalesceOverflow(t *testing.T) {
+	changes := coalesce("/plugins", []utils.WatchEvent{
+		{Op: utils.WatchCreate, Name: "a.jar"},
+		{Op: utils.WatchOverflow},
+	})
+
+	want := []FileChange{
+		{Type: "create", Path: "/plugins/a.jar"},
+		{Type: "rescan", Path: "/plugins"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("coalesce() = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("coalesce() = %v, want %v", changes, want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package templates
+
+import (
+	"daemon/parser"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
+)
+
+var ErrUnsupportedEgg = errors.New("unsupported egg format")
+
+// egg is a Pterodactyl or Pelican egg export, of the PTDL_v1 or PTDL_v2
+// format.
+type egg struct {
+	Meta struct {
+		Version string `json:"version"`
+	} `json:"meta"`
+
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Features    []string `json:"features"`
+
+	DockerImages map[string]string `json:"docker_images"`
+	Images       []string          `json:"images"`
+	Image        string            `json:"image"`
+	FileDenylist []string          `json:"file_denylist"`
+
+	Startup string `json:"startup"`
+	Config  struct {
+		Files   json.RawMessage `json:"files"`
+		Startup json.RawMessage `json:"startup"`
+		Logs    json.RawMessage `json:"logs"`
+		Stop    string          `json:"stop"`
+	} `json:"config"`
+
+	Scripts struct {
+		Installation struct {
+			Script     string `json:"script"`
+			Container  string `json:"container"`
+			Entrypoint string `json:"entrypoint"`
+		} `json:"installation"`
+	} `json:"scripts"`
+
+	Variables []struct {
+		Name         string          `json:"name"`
+		Description  string          `json:"description"`
+		EnvVariable  string          `json:"env_variable"`
+		DefaultValue string          `json:"default_value"`
+		Rules        json.RawMessage `json:"rules"`
+	} `json:"variables"`
+}
+
+type eggConfigFile struct {
+	Parser string                     `json:"parser"`
+	Find   map[string]json.RawMessage `json:"find"`
+}
+
+// ConvertEgg converts a Pterodactyl or Pelican egg to a template. The features
+// of the egg templates don't support are left out, and described by the
+// returned warnings. The template is given a new uuid but no id.
+func ConvertEgg(data []byte) (Template, []string, error) {
+	var e egg
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Template{}, nil, fmt.Errorf("%w: %s", ErrUnsupportedEgg, err.Error())
+	}
+
+	if e.Meta.Version != "PTDL_v1" && e.Meta.Version != "PTDL_v2" {
+		return Template{}, nil, fmt.Errorf("%w: unknown version %q", ErrUnsupportedEgg, e.Meta.Version)
+	}
+
+	var warnings []string
+	t := Template{
+		Uuid:        uuid.New().String(),
+		Name:        e.Name,
+		Description: e.Description,
+		Docker: Docker{
+			Images:       eggImages(e),
+			StartCommand: e.Startup,
+			StartConfig:  "{}",
+			ConfigFiles:  []ConfigFile{},
+		},
+		Variables: []Variable{},
+		Install: Install{
+			Image:      e.Scripts.Installation.Container,
+			Entrypoint: e.Scripts.Installation.Entrypoint,
+		},
+	}
+
+	if len(t.Docker.Images) == 0 {
+		return Template{}, nil, fmt.Errorf("%w: the egg has no docker images", ErrUnsupportedEgg)
+	}
+
+	if strings.HasPrefix(e.Config.Stop, "^") {
+		warnings = append(warnings, "stopping with the signal "+e.Config.Stop+" is not supported, the container is stopped instead")
+	} else {
+		t.Docker.StopCommand = e.Config.Stop
+	}
+
+	done, err := eggDone(e.Config.Startup)
+	if err != nil {
+		return Template{}, nil, fmt.Errorf("%w: invalid startup config: %s", ErrUnsupportedEgg, err.Error())
+	}
+	if len(done) > 0 {
+		b, _ := json.Marshal(map[string]string{"started": done[0]})
+		t.Docker.StartConfig = string(b)
+	}
+	if len(done) > 1 {
+		warnings = append(warnings, "only the first done string of the startup config is used")
+	}
+
+	files, fileWarnings, err := eggConfigFiles(e.Config.Files)
+	if err != nil {
+		return Template{}, nil, fmt.Errorf("%w: invalid config files: %s", ErrUnsupportedEgg, err.Error())
+	}
+	t.Docker.ConfigFiles = files
+	warnings = append(warnings, fileWarnings...)
+
+	script := strings.ReplaceAll(e.Scripts.Installation.Script, "\r\n", "\n")
+	if strings.Contains(script, "/mnt/server") {
+		script = strings.ReplaceAll(script, "/mnt/server", "/mnt/data")
+		warnings = append(warnings, "the install script uses /mnt/server, which was changed to /mnt/data")
+	}
+	t.InstallScript = script
+
+	for _, v := range e.Variables {
+		rules, err := eggRules(v.Rules)
+		if err != nil {
+			return Template{}, nil, fmt.Errorf("%w: invalid rules of variable %s: %s", ErrUnsupportedEgg, v.EnvVariable, err.Error())
+		}
+
+		typ := "string"
+		for _, rule := range rules {
+			name, _, _ := strings.Cut(rule, ":")
+			switch {
+			case name == "integer" || name == "numeric":
+				typ = "integer"
+			case name == "boolean":
+				typ = "boolean"
+			case !knownRules[name]:
+				warnings = append(warnings, "the rule "+name+" of variable "+v.EnvVariable+" is not supported and is ignored")
+			}
+		}
+
+		t.Variables = append(t.Variables, Variable{
+			Name:            v.Name,
+			Description:     v.Description,
+			EnvironmentName: v.EnvVariable,
+			DefaultValue:    v.DefaultValue,
+			Type:            typ,
+			Rules:           rules,
+		})
+	}
+
+	if len(e.Features) > 0 {
+		warnings = append(warnings, "the features "+strings.Join(e.Features, ", ")+" are not supported")
+	}
+	if len(e.FileDenylist) > 0 {
+		warnings = append(warnings, "the file denylist is not supported")
+	}
+	if logs, err := eggString(e.Config.Logs); err == nil && logs != "" && logs != "{}" && logs != "[]" {
+		warnings = append(warnings, "the logs config is not supported")
+	}
+
+	return t, warnings, nil
+}
+
+func eggImages(e egg) []string {
+	names := make([]string, 0, len(e.DockerImages))
+	for name := range e.DockerImages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	images := []string{}
+	for _, name := range names {
+		images = append(images, e.DockerImages[name])
+	}
+	images = append(images, e.Images...)
+	if e.Image != "" {
+		images = append(images, e.Image)
+	}
+
+	return images
+}
+
+// eggString returns the JSON document in a config field of an egg, which is
+// exported as a string holding it, or as the document itself.
+func eggString(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(s), nil
+	}
+
+	return string(raw), nil
+}
+
+// eggDone returns the done strings of the startup config, which can be a
+// string or a list of them.
+func eggDone(raw json.RawMessage) ([]string, error) {
+	s, err := eggString(raw)
+	if err != nil || s == "" {
+		return nil, err
+	}
+
+	var startup struct {
+		Done json.RawMessage `json:"done"`
+	}
+	if err := json.Unmarshal([]byte(s), &startup); err != nil {
+		return nil, err
+	}
+
+	if len(startup.Done) == 0 || string(startup.Done) == "null" {
+		return nil, nil
+	}
+
+	var done []string
+	if startup.Done[0] == '"' {
+		var d string
+		if err := json.Unmarshal(startup.Done, &d); err != nil {
+			return nil, err
+		}
+		done = []string{d}
+	} else if err := json.Unmarshal(startup.Done, &done); err != nil {
+		return nil, err
+	}
+
+	return done, nil
+}
+
+func eggConfigFiles(raw json.RawMessage) ([]ConfigFile, []string, error) {
+	s, err := eggString(raw)
+	if err != nil || s == "" || s == "[]" {
+		return []ConfigFile{}, nil, err
+	}
+
+	var files map[string]eggConfigFile
+	if err := json.Unmarshal([]byte(s), &files); err != nil {
+		return nil, nil, err
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var warnings []string
+	out := []ConfigFile{}
+	for _, p := range paths {
+		f := files[p]
+		switch f.Parser {
+		case "properties", "yaml", "yml", "json", "ini", "xml", "file":
+		default:
+			warnings = append(warnings, "the parser "+f.Parser+" of config file "+p+" is not supported, the file is skipped")
+			continue
+		}
+
+		matches := make([]string, 0, len(f.Find))
+		for m := range f.Find {
+			matches = append(matches, m)
+		}
+		sort.Strings(matches)
+
+		replacements := []parser.Replacement{}
+		for _, m := range matches {
+			r, err := eggReplacements(m, f.Find[m])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s: %w", p, m, err)
+			}
+			replacements = append(replacements, r...)
+		}
+
+		out = append(out, ConfigFile{
+			Path:    p,
+			Parser:  f.Parser,
+			Replace: replacements,
+		})
+	}
+
+	return out, warnings, nil
+}
+
+// eggReplacements converts a find entry of a config file, whose value is the
+// value to set, or an object of the values to set by the value they replace.
+func eggReplacements(match string, raw json.RawMessage) ([]parser.Replacement, error) {
+	if len(raw) > 0 && raw[0] == '{' {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, err
+		}
+
+		ifValues := make([]string, 0, len(values))
+		for v := range values {
+			ifValues = append(ifValues, v)
+		}
+		sort.Strings(ifValues)
+
+		var out []parser.Replacement
+		for _, v := range ifValues {
+			with, err := eggValue(values[v])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, parser.Replacement{Match: match, IfValue: v, ReplaceWith: with})
+		}
+		return out, nil
+	}
+
+	with, err := eggValue(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return []parser.Replacement{{Match: match, ReplaceWith: with}}, nil
+}
+
+// eggValue returns a value to set as a string, whatever its JSON type.
+func eggValue(raw json.RawMessage) (string, error) {
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	if _, ok := v.([]interface{}); ok {
+		return "", errors.New("lists can't be set")
+	}
+
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// eggRules returns the rules of a variable, which are a string of rules
+// separated by "|", or a list of them.
+func eggRules(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return []string{}, nil
+	}
+
+	var rules []string
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		if s != "" {
+			rules = strings.Split(s, "|")
+		}
+	} else if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, rule := range rules {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			out = append(out, rule)
+		}
+	}
+
+	return out, nil
+}
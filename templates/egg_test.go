@@ -0,0 +1,205 @@
+package templates
+
+import (
+	"daemon/parser"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// testEgg is a PTDL_v2 egg as Pelican exports it, with the config fields as
+// strings holding JSON.
+const testEgg = `{
+    "meta": {"version": "PTDL_v2"},
+    "name": "Paper",
+    "description": "A fork of Spigot.",
+    "features": ["eula"],
+    "docker_images": {"Java 21": "ghcr.io/java:21", "Java 17": "ghcr.io/java:17"},
+    "file_denylist": [],
+    "startup": "java -Xmx{{SERVER_MEMORY}}M -jar {{SERVER_JARFILE}}",
+    "config": {
+        "files": "{\"server.properties\": {\"parser\": \"properties\", \"find\": {\"server-port\": \"{{server.build.default.port}}\", \"online-mode\": {\"false\": \"true\"}}}, \"config.lua\": {\"parser\": \"lua\", \"find\": {}}}",
+        "startup": "{\"done\": [\")! For help, type \", \"Done\"]}",
+        "logs": "{}",
+        "stop": "stop"
+    },
+    "scripts": {
+        "installation": {
+            "script": "#!/bin/bash\r\ncd /mnt/server\r\ncurl -o server.jar $URL\r\n",
+            "container": "ghcr.io/installers:debian",
+            "entrypoint": "bash"
+        }
+    },
+    "variables": [
+        {"name": "Jar", "description": "The jar file.", "env_variable": "SERVER_JARFILE", "default_value": "server.jar", "rules": "required|string|max:20"},
+        {"name": "Players", "env_variable": "MAX_PLAYERS", "default_value": "20", "rules": ["required", "integer", "alpha_num"]},
+        {"name": "Whitelist", "env_variable": "WHITELIST", "default_value": "0", "rules": "boolean"}
+    ]
+}`
+
+func TestConvertEgg(t *testing.T) {
+	tmpl, warnings, err := ConvertEgg([]byte(testEgg))
+	if err != nil {
+		t.Fatalf("ConvertEgg() failed: %v", err)
+	}
+
+	if tmpl.Uuid == "" || tmpl.Id != 0 || tmpl.Name != "Paper" || tmpl.Description != "A fork of Spigot." {
+		t.Fatalf("unexpected template: %+v", tmpl)
+	}
+	if !slices.Equal(tmpl.Docker.Images, []string{"ghcr.io/java:17", "ghcr.io/java:21"}) {
+		t.Fatalf("images = %q", tmpl.Docker.Images)
+	}
+	if tmpl.Docker.StopCommand != "stop" || tmpl.Docker.StartConfig != `{"started":")! For help, type "}` {
+		t.Fatalf("stop command %q, start config %q", tmpl.Docker.StopCommand, tmpl.Docker.StartConfig)
+	}
+	if tmpl.InstallScript != "#!/bin/bash\ncd /mnt/data\ncurl -o server.jar $URL\n" {
+		t.Fatalf("install script = %q", tmpl.InstallScript)
+	}
+	if tmpl.Install.Image != "ghcr.io/installers:debian" || tmpl.Install.Entrypoint != "bash" {
+		t.Fatalf("install = %+v", tmpl.Install)
+	}
+
+	wantFiles := []ConfigFile{{
+		Path:   "server.properties",
+		Parser: "properties",
+		Replace: []parser.Replacement{
+			{Match: "online-mode", IfValue: "false", ReplaceWith: "true"},
+			{Match: "server-port", ReplaceWith: "{{server.build.default.port}}"},
+		},
+	}}
+	if got, _ := json.Marshal(tmpl.Docker.ConfigFiles); string(got) != mustJson(t, wantFiles) {
+		t.Fatalf("config files = %s", got)
+	}
+
+	wantVariables := []Variable{
+		{Name: "Jar", Description: "The jar file.", EnvironmentName: "SERVER_JARFILE", DefaultValue: "server.jar", Type: "string", Rules: []string{"required", "string", "max:20"}},
+		{Name: "Players", EnvironmentName: "MAX_PLAYERS", DefaultValue: "20", Type: "integer", Rules: []string{"required", "integer", "alpha_num"}},
+		{Name: "Whitelist", EnvironmentName: "WHITELIST", DefaultValue: "0", Type: "boolean", Rules: []string{"boolean"}},
+	}
+	if got, _ := json.Marshal(tmpl.Variables); string(got) != mustJson(t, wantVariables) {
+		t.Fatalf("variables = %s", got)
+	}
+
+	wantWarnings := []string{
+		"only the first done string of the startup config is used",
+		"the parser lua of config file config.lua is not supported, the file is skipped",
+		"the install script uses /mnt/server, which was changed to /mnt/data",
+		"the rule alpha_num of variable MAX_PLAYERS is not supported and is ignored",
+		"the features eula are not supported",
+	}
+	if !slices.Equal(warnings, wantWarnings) {
+		t.Fatalf("warnings =\n%q\nwant\n%q", warnings, wantWarnings)
+	}
+}
+
+func mustJson(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestConvertEggErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		egg  string
+	}{
+		{name: "not json", egg: "egg"},
+		{name: "unknown version", egg: `{"meta": {"version": "PTDL_v3"}, "docker_images": {"a": "b"}}`},
+		{name: "no images", egg: `{"meta": {"version": "PTDL_v1"}}`},
+		{name: "invalid startup", egg: `{"meta": {"version": "PTDL_v1"}, "image": "a", "config": {"startup": "{"}}`},
+		{name: "invalid files", egg: `{"meta": {"version": "PTDL_v1"}, "image": "a", "config": {"files": "[1]"}}`},
+		{name: "list value", egg: `{"meta": {"version": "PTDL_v1"}, "image": "a", "config": {"files": {"a.yml": {"parser": "yaml", "find": {"k": [1]}}}}}`},
+		{name: "invalid rules", egg: `{"meta": {"version": "PTDL_v1"}, "image": "a", "variables": [{"env_variable": "A", "rules": 1}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ConvertEgg([]byte(tt.egg)); !errors.Is(err, ErrUnsupportedEgg) {
+				t.Fatalf("ConvertEgg() = %v, want ErrUnsupportedEgg", err)
+			}
+		})
+	}
+}
+
+func TestConvertEggV1(t *testing.T) {
+	// PTDL_v1 eggs have the image as a string, the config fields as
+	// documents and the stop as a signal.
+	egg := `{
+        "meta": {"version": "PTDL_v1"},
+        "name": "Old",
+        "image": "quay.io/java:8",
+        "config": {
+            "files": {"config.yml": {"parser": "yaml", "find": {"listeners[0].host": "0.0.0.0:25577", "max": 10, "on": true}}},
+            "startup": {"done": "Listening on "},
+            "logs": {"custom": false},
+            "stop": "^C"
+        },
+        "variables": [{"env_variable": "A", "rules": null}]
+    }`
+
+	tmpl, warnings, err := ConvertEgg([]byte(egg))
+	if err != nil {
+		t.Fatalf("ConvertEgg() failed: %v", err)
+	}
+
+	if !slices.Equal(tmpl.Docker.Images, []string{"quay.io/java:8"}) || tmpl.Docker.StopCommand != "" {
+		t.Fatalf("images %q, stop command %q", tmpl.Docker.Images, tmpl.Docker.StopCommand)
+	}
+	if tmpl.Docker.StartConfig != `{"started":"Listening on "}` {
+		t.Fatalf("start config = %q", tmpl.Docker.StartConfig)
+	}
+
+	wantFiles := []ConfigFile{{
+		Path:   "config.yml",
+		Parser: "yaml",
+		Replace: []parser.Replacement{
+			{Match: "listeners[0].host", ReplaceWith: "0.0.0.0:25577"},
+			{Match: "max", ReplaceWith: "10"},
+			{Match: "on", ReplaceWith: "true"},
+		},
+	}}
+	if got, _ := json.Marshal(tmpl.Docker.ConfigFiles); string(got) != mustJson(t, wantFiles) {
+		t.Fatalf("config files = %s", got)
+	}
+	if len(tmpl.Variables) != 1 || tmpl.Variables[0].Type != "string" || len(tmpl.Variables[0].Rules) != 0 {
+		t.Fatalf("variables = %+v", tmpl.Variables)
+	}
+
+	wantWarnings := []string{
+		"stopping with the signal ^C is not supported, the container is stopped instead",
+		"the logs config is not supported",
+	}
+	if !slices.Equal(warnings, wantWarnings) {
+		t.Fatalf("warnings =\n%q\nwant\n%q", warnings, wantWarnings)
+	}
+}
+
+func TestEggRules(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []string
+	}{
+		{raw: `"required|string|max:20"`, want: []string{"required", "string", "max:20"}},
+		{raw: `" required | in:a,b "`, want: []string{"required", "in:a,b"}},
+		{raw: `["nullable", "", "regex:/^[a|b]$/"]`, want: []string{"nullable", "regex:/^[a|b]$/"}},
+		{raw: `""`, want: []string{}},
+		{raw: `null`, want: []string{}},
+		{raw: ``, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		got, err := eggRules(json.RawMessage(tt.raw))
+		if err != nil {
+			t.Errorf("eggRules(%s) failed: %v", tt.raw, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("eggRules(%s) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
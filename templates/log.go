@@ -0,0 +1,5 @@
+package templates
+
+import "daemon/logging"
+
+var log = logging.For("templates")
@@ -0,0 +1,209 @@
+package templates
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// knownRules are the rules variables are validated with.
+var knownRules = map[string]bool{
+	"required": true, "nullable": true, "string": true, "integer": true, "numeric": true,
+	"boolean": true, "in": true, "regex": true, "min": true, "max": true, "between": true,
+}
+
+// ValidationError holds the messages of the variables that failed their
+// rules, by their environment name.
+type ValidationError struct {
+	Fields map[string][]string `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := []string{}
+	for _, name := range names {
+		messages = append(messages, e.Fields[name]...)
+	}
+
+	return "invalid variables: " + strings.Join(messages, " ")
+}
+
+func (e *ValidationError) add(field string, message string) {
+	e.Fields[field] = append(e.Fields[field], message)
+}
+
+// ValidateVariables checks the values of the variables of the template
+// against their rules, and returns them by environment name with the ones
+// that are not given filled from their default value. Values of names the
+// template doesn't define are dropped. The error is a *ValidationError when
+// some of the values don't pass their rules.
+func (t Template) ValidateVariables(values map[string]string) (map[string]string, error) {
+	result := map[string]string{}
+	verr := &ValidationError{Fields: map[string][]string{}}
+
+	for _, v := range t.Variables {
+		value, ok := values[v.EnvironmentName]
+		if !ok {
+			value = v.DefaultValue
+		}
+		result[v.EnvironmentName] = value
+
+		for _, message := range v.Validate(value) {
+			verr.add(v.EnvironmentName, message)
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+
+	return result, nil
+}
+
+// Validate checks a value against the rules of the variable, and returns a
+// message for each one it fails. Empty values only have to pass the required
+// rule. Rules that are not known are ignored.
+func (v Variable) Validate(value string) []string {
+	name := v.Name
+	if name == "" {
+		name = v.EnvironmentName
+	}
+
+	numeric := false
+	for _, rule := range v.Rules {
+		if rule == "integer" || rule == "numeric" {
+			numeric = true
+		}
+	}
+
+	if value == "" {
+		for _, rule := range v.Rules {
+			if rule == "required" {
+				return []string{"The " + name + " field is required."}
+			}
+		}
+
+		return nil
+	}
+
+	var messages []string
+	for _, rule := range v.Rules {
+		rule, arg, _ := strings.Cut(rule, ":")
+
+		var message string
+		switch rule {
+		case "required", "nullable", "string":
+			// empty values are checked above, and every value is a string.
+		case "integer":
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				message = "The " + name + " field must be an integer."
+			}
+		case "numeric":
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				message = "The " + name + " field must be a number."
+			}
+		case "boolean":
+			switch strings.ToLower(value) {
+			case "true", "false", "1", "0":
+			default:
+				message = "The " + name + " field must be true or false."
+			}
+		case "in":
+			found := false
+			for _, option := range strings.Split(arg, ",") {
+				if value == option {
+					found = true
+					break
+				}
+			}
+			if !found {
+				message = "The selected " + name + " is invalid."
+			}
+		case "regex":
+			re, err := compileRuleRegex(arg)
+			if err != nil {
+				message = "The " + name + " field has an invalid regex rule."
+			} else if !re.MatchString(value) {
+				message = "The " + name + " field format is invalid."
+			}
+		case "min", "max", "between":
+			message = checkSize(name, rule, arg, value, numeric)
+		}
+
+		if message != "" {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// compileRuleRegex compiles the pattern of a regex rule, which can be written
+// with slashes around it as in PHP.
+func compileRuleRegex(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) >= 2 && pattern[0] == '/' {
+		if i := strings.LastIndexByte(pattern, '/'); i > 0 {
+			flags := pattern[i+1:]
+			pattern = pattern[1:i]
+			if strings.Contains(flags, "i") {
+				pattern = "(?i)" + pattern
+			}
+		}
+	}
+
+	return regexp.Compile(pattern)
+}
+
+// checkSize checks a min, max or between rule, against the value itself for
+// integers and against its length otherwise.
+func checkSize(name string, rule string, arg string, value string, numeric bool) string {
+	bounds := strings.Split(arg, ",")
+	if (rule == "between") != (len(bounds) == 2) {
+		return "The " + name + " field has an invalid " + rule + " rule."
+	}
+
+	limits := make([]float64, len(bounds))
+	for i, b := range bounds {
+		l, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return "The " + name + " field has an invalid " + rule + " rule."
+		}
+		limits[i] = l
+	}
+
+	size := float64(utf8.RuneCountInString(value))
+	unit := " characters"
+	if numeric {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			// reported by the integer or numeric rule.
+			return ""
+		}
+		size = n
+		unit = ""
+	}
+
+	switch rule {
+	case "min":
+		if size < limits[0] {
+			return "The " + name + " field must be at least " + bounds[0] + unit + "."
+		}
+	case "max":
+		if size > limits[0] {
+			return "The " + name + " field must not be greater than " + bounds[0] + unit + "."
+		}
+	case "between":
+		if size < limits[0] || size > limits[1] {
+			return "The " + name + " field must be between " + bounds[0] + " and " + bounds[1] + unit + "."
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,79 @@
+package templates
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		value string
+		want  []string
+	}{
+		{name: "required empty", rules: []string{"required", "integer"}, value: "", want: []string{"The Port field is required."}},
+		{name: "nullable empty", rules: []string{"nullable", "integer", "min:1"}, value: ""},
+		{name: "integer", rules: []string{"integer"}, value: "25565"},
+		{name: "not an integer", rules: []string{"integer"}, value: "1.5", want: []string{"The Port field must be an integer."}},
+		{name: "numeric", rules: []string{"numeric"}, value: "1.5"},
+		{name: "not numeric", rules: []string{"numeric"}, value: "x", want: []string{"The Port field must be a number."}},
+		{name: "boolean", rules: []string{"boolean"}, value: "TRUE"},
+		{name: "not boolean", rules: []string{"boolean"}, value: "yes", want: []string{"The Port field must be true or false."}},
+		{name: "in", rules: []string{"in:paper,vanilla"}, value: "paper"},
+		{name: "not in", rules: []string{"in:paper,vanilla"}, value: "pape", want: []string{"The selected Port is invalid."}},
+		{name: "regex", rules: []string{"regex:^[0-9]+$"}, value: "123"},
+		{name: "regex with slashes", rules: []string{"regex:/^[a-z]+$/i"}, value: "ABC"},
+		{name: "regex mismatch", rules: []string{"regex:/^[a-z]+$/"}, value: "ABC", want: []string{"The Port field format is invalid."}},
+		{name: "invalid regex", rules: []string{"regex:["}, value: "x", want: []string{"The Port field has an invalid regex rule."}},
+		{name: "min integer", rules: []string{"integer", "min:1024"}, value: "80", want: []string{"The Port field must be at least 1024."}},
+		{name: "max integer", rules: []string{"max:65535", "integer"}, value: "70000", want: []string{"The Port field must not be greater than 65535."}},
+		{name: "between integer", rules: []string{"integer", "between:1,10"}, value: "10"},
+		{name: "min length", rules: []string{"string", "min:3"}, value: "ab", want: []string{"The Port field must be at least 3 characters."}},
+		{name: "max length in runes", rules: []string{"max:3"}, value: "äöü"},
+		{name: "between length", rules: []string{"between:2,3"}, value: "abcd", want: []string{"The Port field must be between 2 and 3 characters."}},
+		{name: "invalid between", rules: []string{"between:1"}, value: "a", want: []string{"The Port field has an invalid between rule."}},
+		{name: "invalid min", rules: []string{"min:x"}, value: "a", want: []string{"The Port field has an invalid min rule."}},
+		{name: "size of a non number", rules: []string{"integer", "min:1"}, value: "x", want: []string{"The Port field must be an integer."}},
+		{name: "unknown rule", rules: []string{"alpha_dash"}, value: "a b"},
+		{name: "several failures", rules: []string{"integer", "in:1,2"}, value: "x", want: []string{"The Port field must be an integer.", "The selected Port is invalid."}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := Variable{Name: "Port", EnvironmentName: "SERVER_PORT", Rules: tt.rules}
+			if got := v.Validate(tt.value); !slices.Equal(got, tt.want) {
+				t.Fatalf("Validate(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateVariables(t *testing.T) {
+	tmpl := Template{Variables: []Variable{
+		{EnvironmentName: "SERVER_JAR", DefaultValue: "server.jar", Rules: []string{"required", "string"}},
+		{EnvironmentName: "MAX_PLAYERS", DefaultValue: "20", Rules: []string{"required", "integer", "between:1,100"}},
+	}}
+
+	values, err := tmpl.ValidateVariables(map[string]string{"MAX_PLAYERS": "50", "UNKNOWN": "x"})
+	if err != nil {
+		t.Fatalf("ValidateVariables() failed: %v", err)
+	}
+	if len(values) != 2 || values["SERVER_JAR"] != "server.jar" || values["MAX_PLAYERS"] != "50" {
+		t.Fatalf("ValidateVariables() = %v", values)
+	}
+
+	_, err = tmpl.ValidateVariables(map[string]string{"SERVER_JAR": "", "MAX_PLAYERS": "500"})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("ValidateVariables() = %v, want a *ValidationError", err)
+	}
+	if len(verr.Fields["SERVER_JAR"]) != 1 || len(verr.Fields["MAX_PLAYERS"]) != 1 {
+		t.Fatalf("the errors are %v", verr.Fields)
+	}
+	want := "invalid variables: The MAX_PLAYERS field must be between 1 and 100. The SERVER_JAR field is required."
+	if err.Error() != want {
+		t.Fatalf("Error() = %q, want %q", err.Error(), want)
+	}
+}
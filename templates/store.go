@@ -0,0 +1,514 @@
+package templates
+
+import (
+	"daemon/config"
+	"daemon/utils"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+	ErrTemplateExists   = errors.New("a template with the same id or uuid already exists")
+	ErrInvalidTemplate  = errors.New("invalid template uuid")
+	ErrVersionConflict  = errors.New("template was changed since the given version")
+	ErrVersionNotFound  = errors.New("template version not found")
+)
+
+const (
+	// watchDebounce is how long the templates directory has to stay unchanged
+	// after a change before the templates are reloaded.
+	watchDebounce = 500 * time.Millisecond
+
+	// watchInterval is how often the templates directory is checked for
+	// changes made to it outside of the daemon, where it can't be watched.
+	watchInterval = 5 * time.Second
+)
+
+// TemplateVersion describes a version in the history of a template.
+type TemplateVersion struct {
+	Version   int   `json:"version"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type entry struct {
+	template Template
+	file     string
+}
+
+var (
+	mu        sync.RWMutex
+	loaded    bool
+	cache     map[string]*entry
+	signature string
+)
+
+func templatesDir() string {
+	return utils.Normalize(config.Get().System.DataDirectory + "/templates")
+}
+
+func historyDir(uuid string) string {
+	return utils.Normalize(config.Get().System.DataDirectory + "/template_history/" + uuid)
+}
+
+// Load reads the templates in the cache, and starts watching the templates
+// directory to reload them when its files change.
+func Load() error {
+	mu.Lock()
+	err := reload()
+	mu.Unlock()
+
+	go watch()
+	return err
+}
+
+// reload reads every template file in the cache. Templates whose id or uuid
+// is already taken by another one are skipped. The caller must hold mu.
+func reload() error {
+	dir := templatesDir()
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c := map[string]*entry{}
+	ids := map[int]string{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		var t Template
+		if err := json.Unmarshal(b, &t); err != nil {
+			log.WithError(err).Warnf("skipping invalid template file %s", f.Name())
+			continue
+		}
+
+		if t.Uuid == "" {
+			log.Warnf("skipping template file %s without uuid", f.Name())
+			continue
+		}
+		if _, ok := c[t.Uuid]; ok {
+			log.Warnf("skipping template file %s, its uuid %s is already used", f.Name(), t.Uuid)
+			continue
+		}
+		if other, ok := ids[t.Id]; ok {
+			log.Warnf("skipping template file %s, its id %d is already used by %s", f.Name(), t.Id, other)
+			continue
+		}
+
+		if t.Version == 0 {
+			t.Version = 1
+		}
+
+		c[t.Uuid] = &entry{template: t, file: f.Name()}
+		ids[t.Id] = t.Uuid
+	}
+
+	cache = c
+	loaded = true
+	signature = dirSignature()
+	return nil
+}
+
+// ensureLoaded fills the cache when it wasn't loaded yet.
+func ensureLoaded() error {
+	mu.RLock()
+	ok := loaded
+	mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if loaded {
+		return nil
+	}
+
+	return reload()
+}
+
+// dirSignature returns a string that changes when a template file is added,
+// removed or written.
+func dirSignature() string {
+	files, err := os.ReadDir(templatesDir())
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		b.WriteString(f.Name() + ":" + strconv.FormatInt(info.Size(), 10) + ":" + strconv.FormatInt(info.ModTime().UnixNano(), 10) + ";")
+	}
+
+	return b.String()
+}
+
+// watch reloads the templates when the templates directory changes. It is
+// watched with the platform watcher, and polled where that isn't available.
+func watch() {
+	dir := templatesDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.WithError(err).Warn("failed to create the templates directory, polling it instead")
+		poll()
+		return
+	}
+
+	w, err := utils.WatchDir(dir)
+	if err != nil {
+		log.WithError(err).Warn("failed to watch the templates directory, polling it instead")
+		poll()
+		return
+	}
+
+	// the watcher calls back from a single goroutine, so the timer is only
+	// used by it.
+	var timer *time.Timer
+	err = w.Read(func(e utils.WatchEvent) {
+		if e.Op == utils.WatchGone {
+			_ = w.Close()
+			return
+		}
+
+		if timer == nil {
+			timer = time.AfterFunc(watchDebounce, reloadChanged)
+		} else {
+			timer.Reset(watchDebounce)
+		}
+	})
+	if err != nil {
+		log.WithError(err).Warn("failed to watch the templates directory, polling it instead")
+	} else {
+		log.Warn("templates directory was removed, polling it instead")
+	}
+	poll()
+}
+
+func poll() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reloadChanged()
+	}
+}
+
+// reloadChanged reloads the templates if their files changed since they were
+// last read.
+func reloadChanged() {
+	sig := dirSignature()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if sig != signature {
+		log.Debug("templates directory changed, reloading templates")
+		if err := reload(); err != nil {
+			log.WithError(err).Error("failed to reload templates")
+		}
+	}
+}
+
+func GetTemplates() ([]Template, error) {
+	if err := ensureLoaded(); err != nil {
+		return []Template{}, err
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	templates := make([]Template, 0, len(cache))
+	for _, e := range cache {
+		templates = append(templates, e.template)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Id < templates[j].Id
+	})
+
+	return templates, nil
+}
+
+func GetTemplate(id int) (Template, error) {
+	if err := ensureLoaded(); err != nil {
+		return Template{}, err
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if e := findById(id); e != nil {
+		return e.template, nil
+	}
+
+	return Template{}, ErrTemplateNotFound
+}
+
+// GetTemplateByUuid returns the template with the given uuid.
+func GetTemplateByUuid(uuid string) (Template, error) {
+	if err := ensureLoaded(); err != nil {
+		return Template{}, err
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if e, ok := cache[uuid]; ok {
+		return e.template, nil
+	}
+
+	return Template{}, ErrTemplateNotFound
+}
+
+// findById returns the cache entry of a template. The caller must hold mu.
+func findById(id int) *entry {
+	for _, e := range cache {
+		if e.template.Id == id {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// AddTemplate saves a new template. It is given a uuid and the next free id
+// when it has none, and both must not be used by another template.
+func AddTemplate(t Template) (Template, error) {
+	if err := ensureLoaded(); err != nil {
+		return Template{}, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if t.Uuid == "" {
+		t.Uuid = uuid.New().String()
+	}
+	if t.Uuid != filepath.Base(t.Uuid) || strings.HasPrefix(t.Uuid, ".") {
+		return Template{}, ErrInvalidTemplate
+	}
+
+	if t.Id == 0 {
+		for _, e := range cache {
+			if e.template.Id > t.Id {
+				t.Id = e.template.Id
+			}
+		}
+		t.Id++
+	}
+
+	for _, e := range cache {
+		if e.template.Id == t.Id || e.template.Uuid == t.Uuid {
+			return Template{}, ErrTemplateExists
+		}
+	}
+
+	t.Version = 1
+	t.UpdatedAt = time.Now().Unix()
+
+	e := &entry{template: t, file: t.Uuid + ".json"}
+	if err := write(e); err != nil {
+		return Template{}, err
+	}
+	cache[t.Uuid] = e
+
+	return t, nil
+}
+
+// UpdateTemplate replaces a template, keeping its id and uuid, and adds the
+// new version to its history. When the given template has a version, it must
+// be the current one, so changes made in between aren't overwritten.
+func UpdateTemplate(id int, t Template) (Template, error) {
+	if err := ensureLoaded(); err != nil {
+		return Template{}, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	current := findById(id)
+	if current == nil {
+		return Template{}, ErrTemplateNotFound
+	}
+
+	if t.Version != 0 && t.Version != current.template.Version {
+		return Template{}, ErrVersionConflict
+	}
+
+	// templates written before the history existed start it with the
+	// version they replace.
+	if _, err := os.Stat(versionPath(current.template.Uuid, current.template.Version)); os.IsNotExist(err) {
+		if err := writeVersion(current.template); err != nil {
+			return Template{}, err
+		}
+	}
+
+	t.Id = current.template.Id
+	t.Uuid = current.template.Uuid
+	t.Version = current.template.Version + 1
+	t.UpdatedAt = time.Now().Unix()
+
+	e := &entry{template: t, file: current.file}
+	if err := write(e); err != nil {
+		return Template{}, err
+	}
+	cache[t.Uuid] = e
+
+	return t, nil
+}
+
+// DeleteTemplate removes a template and its history.
+func DeleteTemplate(id int) error {
+	if err := ensureLoaded(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	e := findById(id)
+	if e == nil {
+		return ErrTemplateNotFound
+	}
+
+	if err := os.Remove(filepath.Join(templatesDir(), e.file)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(cache, e.template.Uuid)
+	signature = dirSignature()
+
+	return os.RemoveAll(historyDir(e.template.Uuid))
+}
+
+// GetTemplateVersions returns the versions in the history of a template.
+func GetTemplateVersions(id int) ([]TemplateVersion, error) {
+	t, err := GetTemplate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(historyDir(t.Uuid))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	versions := []TemplateVersion{}
+	for _, f := range files {
+		v, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil || f.IsDir() {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, TemplateVersion{Version: v, UpdatedAt: info.ModTime().Unix()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+
+	return versions, nil
+}
+
+// GetTemplateVersion returns a version from the history of a template.
+func GetTemplateVersion(id int, version int) (Template, error) {
+	t, err := GetTemplate(id)
+	if err != nil {
+		return Template{}, err
+	}
+
+	if version == t.Version {
+		return t, nil
+	}
+
+	b, err := os.ReadFile(versionPath(t.Uuid, version))
+	if os.IsNotExist(err) {
+		return Template{}, ErrVersionNotFound
+	} else if err != nil {
+		return Template{}, err
+	}
+
+	var old Template
+	if err := json.Unmarshal(b, &old); err != nil {
+		return Template{}, err
+	}
+
+	return old, nil
+}
+
+func versionPath(uuid string, version int) string {
+	return filepath.Join(historyDir(uuid), strconv.Itoa(version)+".json")
+}
+
+// write saves a template to its file and to its history. The caller must hold
+// mu.
+func write(e *entry) error {
+	dir := templatesDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(e.template, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, e.file), b); err != nil {
+		return err
+	}
+	signature = dirSignature()
+
+	return writeVersion(e.template)
+}
+
+func writeVersion(t Template) error {
+	if err := os.MkdirAll(historyDir(t.Uuid), 0755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(t, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(versionPath(t.Uuid, t.Version), b)
+}
+
+// writeFileAtomic writes a file through a temporary one, so readers and the
+// watcher never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package templates
+
+import (
+	"crypto/sha256"
+	"daemon/config"
+	"daemon/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoRepository = errors.New("no template repository is configured")
+
+// maxSyncFileSize limits how much is read of the index and the template files.
+const maxSyncFileSize = 10 << 20
+
+// index is the manifest of a template repository. The files are relative to
+// the location of the index.
+type index struct {
+	Templates []struct {
+		Uuid   string `json:"uuid"`
+		File   string `json:"file"`
+		Sha256 string `json:"sha256"`
+	} `json:"templates"`
+}
+
+// SyncResult lists the uuids of the templates of the index by what a sync did
+// with them. Skipped templates were changed locally, or not added by a sync.
+type SyncResult struct {
+	Added     []string          `json:"added"`
+	Updated   []string          `json:"updated"`
+	Unchanged []string          `json:"unchanged"`
+	Skipped   []string          `json:"skipped"`
+	Failed    map[string]string `json:"failed"`
+}
+
+// syncState is what was synced of a template, to tell whether it was changed
+// locally since.
+type syncState struct {
+	Sha256  string `json:"sha256"`
+	Version int    `json:"version"`
+}
+
+var syncMu sync.Mutex
+
+func syncStatePath() string {
+	return utils.Normalize(config.Get().System.DataDirectory + "/template_sync.json")
+}
+
+// Sync adds and updates the templates from a template repository, which is an
+// index.json file, or a directory holding one, on a HTTP server or on disk.
+// The configured repository is used when the source is empty. Templates that
+// were changed since they were last synced are left alone.
+func Sync(source string) (SyncResult, error) {
+	result := SyncResult{
+		Added:     []string{},
+		Updated:   []string{},
+		Unchanged: []string{},
+		Skipped:   []string{},
+		Failed:    map[string]string{},
+	}
+
+	if source == "" {
+		source = config.Get().Templates.Repository
+	}
+	if source == "" {
+		return result, ErrNoRepository
+	}
+
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	r := newRepository(source)
+	b, err := r.read(r.index)
+	if err != nil {
+		return result, fmt.Errorf("failed to read the template index: %w", err)
+	}
+
+	var idx index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return result, fmt.Errorf("invalid template index: %w", err)
+	}
+
+	state, err := loadSyncState()
+	if err != nil {
+		return result, err
+	}
+
+	for _, e := range idx.Templates {
+		name := e.Uuid
+		if name == "" {
+			name = e.File
+		}
+
+		outcome, err := syncTemplate(r, e.Uuid, e.File, e.Sha256, state)
+		if err != nil {
+			result.Failed[name] = err.Error()
+			continue
+		}
+
+		switch outcome {
+		case "added":
+			result.Added = append(result.Added, name)
+		case "updated":
+			result.Updated = append(result.Updated, name)
+		case "unchanged":
+			result.Unchanged = append(result.Unchanged, name)
+		case "skipped":
+			result.Skipped = append(result.Skipped, name)
+		}
+	}
+
+	return result, saveSyncState(state)
+}
+
+func syncTemplate(r *repository, id string, file string, sum string, state map[string]syncState) (string, error) {
+	if file == "" || sum == "" {
+		return "", errors.New("the index entry has no file or checksum")
+	}
+
+	b, err := r.read(r.resolve(file))
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(b)
+	actual := hex.EncodeToString(h[:])
+	if !strings.EqualFold(actual, sum) {
+		return "", errors.New("checksum mismatch, expected " + sum + " but got " + actual)
+	}
+
+	var t Template
+	if err := json.Unmarshal(b, &t); err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+
+	if t.Uuid == "" {
+		t.Uuid = id
+	} else if id != "" && t.Uuid != id {
+		return "", errors.New("the uuid of the template doesn't match the index")
+	}
+
+	local, err := GetTemplateByUuid(t.Uuid)
+	if errors.Is(err, ErrTemplateNotFound) {
+		added, err := AddTemplate(t)
+		if errors.Is(err, ErrTemplateExists) {
+			// the id is taken by a local template.
+			t.Id = 0
+			added, err = AddTemplate(t)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		state[added.Uuid] = syncState{Sha256: actual, Version: added.Version}
+		return "added", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	prev, ok := state[t.Uuid]
+	if !ok || prev.Version != local.Version {
+		return "skipped", nil
+	}
+
+	if strings.EqualFold(prev.Sha256, actual) {
+		return "unchanged", nil
+	}
+
+	t.Version = local.Version
+	updated, err := UpdateTemplate(local.Id, t)
+	if err != nil {
+		return "", err
+	}
+
+	state[updated.Uuid] = syncState{Sha256: actual, Version: updated.Version}
+	return "updated", nil
+}
+
+func loadSyncState() (map[string]syncState, error) {
+	state := map[string]syncState{}
+
+	b, err := os.ReadFile(syncStatePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func saveSyncState(state map[string]syncState) error {
+	b, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(syncStatePath(), b)
+}
+
+// repository reads the index and the template files of a template repository
+// from a HTTP server or from disk.
+type repository struct {
+	index  string
+	remote bool
+	client *http.Client
+}
+
+func newRepository(source string) *repository {
+	remote := strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+	if !remote {
+		source = filepath.FromSlash(strings.TrimPrefix(source, "file://"))
+	}
+
+	index := source
+	if !strings.HasSuffix(source, ".json") {
+		if remote {
+			index = strings.TrimSuffix(source, "/") + "/index.json"
+		} else {
+			index = filepath.Join(source, "index.json")
+		}
+	}
+
+	return &repository{
+		index:  index,
+		remote: remote,
+		client: &http.Client{
+			Timeout: time.Duration(config.Get().Templates.Timeout) * time.Second,
+		},
+	}
+}
+
+// resolve returns the location of a file relative to the index. Files on disk
+// can't be outside of the directory of the index.
+func (r *repository) resolve(file string) string {
+	if r.remote {
+		base, err := url.Parse(r.index)
+		if err != nil {
+			return file
+		}
+		ref, err := url.Parse(file)
+		if err != nil {
+			return file
+		}
+
+		return base.ResolveReference(ref).String()
+	}
+
+	return filepath.Join(filepath.Dir(r.index), filepath.Clean(string(filepath.Separator)+filepath.FromSlash(file)))
+}
+
+func (r *repository) read(location string) ([]byte, error) {
+	var rd io.ReadCloser
+	if r.remote {
+		if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+			return nil, errors.New("files of a remote index must be served over http")
+		}
+
+		res, err := r.client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, errors.New("unexpected status " + res.Status + " for " + location)
+		}
+		rd = res.Body
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		rd = f
+	}
+	defer rd.Close()
+
+	b, err := io.ReadAll(io.LimitReader(rd, maxSyncFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxSyncFileSize {
+		return nil, errors.New(location + " is too large")
+	}
+
+	return b, nil
+}
@@ -0,0 +1,236 @@
+package templates
+
+import (
+	"crypto/sha256"
+	"daemon/config"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestStore points the store at an empty data directory.
+func newTestStore(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	c := config.DefaultConfig(filepath.Join(dir, "config.yml"))
+	c.System.DataDirectory = filepath.Join(dir, "data")
+	config.Set(c)
+
+	mu.Lock()
+	loaded = false
+	cache = nil
+	mu.Unlock()
+}
+
+// fakeRepository serves a template repository over HTTP.
+type fakeRepository struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	index map[string]string // uuid -> checksum in the index
+}
+
+func newFakeRepository(t *testing.T) (*fakeRepository, *httptest.Server) {
+	r := &fakeRepository{files: map[string][]byte{}, index: map[string]string{}}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	return r, srv
+}
+
+func (r *fakeRepository) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/repo/index.json" {
+		var idx index
+		for id, sum := range r.index {
+			idx.Templates = append(idx.Templates, struct {
+				Uuid   string `json:"uuid"`
+				File   string `json:"file"`
+				Sha256 string `json:"sha256"`
+			}{Uuid: id, File: "templates/" + id + ".json", Sha256: sum})
+		}
+		_ = json.NewEncoder(w).Encode(idx)
+		return
+	}
+
+	b, ok := r.files[strings.TrimPrefix(req.URL.Path, "/repo/templates/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write(b)
+}
+
+// put publishes a template with its checksum in the index.
+func (r *fakeRepository) put(t *testing.T, tmpl Template) {
+	t.Helper()
+
+	b, err := json.Marshal(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(b)
+
+	r.mu.Lock()
+	r.files[tmpl.Uuid+".json"] = b
+	r.index[tmpl.Uuid] = hex.EncodeToString(h[:])
+	r.mu.Unlock()
+}
+
+func testTemplate(uuid string, name string) Template {
+	t := NewTestTemplate()
+	t.Id = 0
+	t.Uuid = uuid
+	t.Name = name
+	return t
+}
+
+func TestSync(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare changes the repository and the local templates after the
+		// first sync, which added template "a".
+		prepare func(t *testing.T, r *fakeRepository)
+		want    SyncResult
+		// wantName is the name of template "a" after the second sync.
+		wantName string
+	}{
+		{
+			name:     "unchanged",
+			prepare:  func(t *testing.T, r *fakeRepository) {},
+			want:     SyncResult{Unchanged: []string{"a"}},
+			wantName: "A",
+		},
+		{
+			name: "added",
+			prepare: func(t *testing.T, r *fakeRepository) {
+				r.put(t, testTemplate("b", "B"))
+			},
+			want:     SyncResult{Added: []string{"b"}, Unchanged: []string{"a"}},
+			wantName: "A",
+		},
+		{
+			name: "updated",
+			prepare: func(t *testing.T, r *fakeRepository) {
+				r.put(t, testTemplate("a", "A2"))
+			},
+			want:     SyncResult{Updated: []string{"a"}},
+			wantName: "A2",
+		},
+		{
+			name: "checksum mismatch",
+			prepare: func(t *testing.T, r *fakeRepository) {
+				r.put(t, testTemplate("a", "A2"))
+				r.index["a"] = strings.Repeat("0", 64)
+			},
+			want:     SyncResult{Failed: map[string]string{"a": "checksum mismatch"}},
+			wantName: "A",
+		},
+		{
+			name: "locally changed",
+			prepare: func(t *testing.T, r *fakeRepository) {
+				local, err := GetTemplateByUuid("a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				local.Name = "local"
+				if _, err := UpdateTemplate(local.Id, local); err != nil {
+					t.Fatal(err)
+				}
+				r.put(t, testTemplate("a", "A2"))
+			},
+			want:     SyncResult{Skipped: []string{"a"}},
+			wantName: "local",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			r, srv := newFakeRepository(t)
+			r.put(t, testTemplate("a", "A"))
+
+			res, err := Sync(srv.URL + "/repo")
+			if err != nil {
+				t.Fatalf("first Sync() failed: %v", err)
+			}
+			if len(res.Added) != 1 || res.Added[0] != "a" {
+				t.Fatalf("first Sync() = %+v, want a added", res)
+			}
+
+			tt.prepare(t, r)
+
+			res, err = Sync(srv.URL + "/repo")
+			if err != nil {
+				t.Fatalf("Sync() failed: %v", err)
+			}
+			checkResult(t, "added", res.Added, tt.want.Added)
+			checkResult(t, "updated", res.Updated, tt.want.Updated)
+			checkResult(t, "unchanged", res.Unchanged, tt.want.Unchanged)
+			checkResult(t, "skipped", res.Skipped, tt.want.Skipped)
+			if len(res.Failed) != len(tt.want.Failed) {
+				t.Fatalf("failed = %v, want %v", res.Failed, tt.want.Failed)
+			}
+			for id, msg := range tt.want.Failed {
+				if !strings.Contains(res.Failed[id], msg) {
+					t.Fatalf("failed[%s] = %q, want %q", id, res.Failed[id], msg)
+				}
+			}
+
+			a, err := GetTemplateByUuid("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Name != tt.wantName {
+				t.Fatalf("template a is named %q, want %q", a.Name, tt.wantName)
+			}
+		})
+	}
+}
+
+func checkResult(t *testing.T, name string, got []string, want []string) {
+	t.Helper()
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("%s = %v, want %v", name, got, want)
+	}
+}
+
+func TestSyncSkipsTemplatesNotAddedBySync(t *testing.T) {
+	newTestStore(t)
+	if _, err := AddTemplate(testTemplate("a", "local")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, srv := newFakeRepository(t)
+	r.put(t, testTemplate("a", "A"))
+
+	res, err := Sync(srv.URL + "/repo/index.json")
+	if err != nil {
+		t.Fatalf("Sync() failed: %v", err)
+	}
+	if len(res.Skipped) != 1 || res.Skipped[0] != "a" {
+		t.Fatalf("Sync() = %+v, want a skipped", res)
+	}
+
+	a, err := GetTemplateByUuid("a")
+	if err != nil || a.Name != "local" {
+		t.Fatalf("the local template was overwritten: %+v, %v", a, err)
+	}
+}
+
+func TestSyncWithoutRepository(t *testing.T) {
+	newTestStore(t)
+
+	if _, err := Sync(""); !errors.Is(err, ErrNoRepository) {
+		t.Fatalf("Sync() = %v, want ErrNoRepository", err)
+	}
+}
@@ -1,11 +1,7 @@
 package templates
 
 import (
-	"daemon/config"
-	"daemon/utils"
-	"encoding/json"
-	"errors"
-	"os"
+	"daemon/parser"
 )
 
 type Template struct {
@@ -17,7 +13,25 @@ type Template struct {
 	Docker    Docker     `json:"docker"`
 	Variables []Variable `json:"variables"`
 
-	InstallScript string `json:"install_script"`
+	InstallScript string  `json:"install_script"`
+	Install       Install `json:"install"`
+
+	// Version is increased on every update of the template, whose previous
+	// versions are kept in its history.
+	Version   int   `json:"version"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// Install is the container the install script runs in. Without an image the
+// runtime image of the server is used, and the limits of the config are used
+// for the ones that are zero.
+type Install struct {
+	Image      string `json:"image"`
+	Entrypoint string `json:"entrypoint"`
+
+	Memory  int64 `json:"memory"`  // bytes
+	Cpu     int64 `json:"cpu"`     // cpu shares
+	Timeout int   `json:"timeout"` // seconds
 }
 
 type Docker struct {
@@ -30,9 +44,14 @@ type Docker struct {
 	ConfigFiles []ConfigFile `json:"config_files"`
 }
 
+// ConfigFile is a file in the server volume that is patched before each start.
+// Content is written when the file doesn't exist yet, then the values of the
+// replacements are set with the parser of the file format.
 type ConfigFile struct {
-	Path    string `json:"path"`
-	Content string `json:"content"`
+	Path    string               `json:"path"`
+	Parser  string               `json:"parser"`
+	Content string               `json:"content"`
+	Replace []parser.Replacement `json:"replace"`
 }
 
 type Variable struct {
@@ -45,60 +64,6 @@ type Variable struct {
 	Rules []string `json:"rules"`
 }
 
-func GetTemplates() ([]Template, error) {
-	c := *config.Get()
-	data := utils.Normalize(c.System.DataDirectory + "/templates")
-
-	b, err := os.ReadDir(data)
-	if err != nil {
-		return []Template{}, err
-	}
-
-	templates := []Template{}
-	for _, f := range b {
-		file, err := os.ReadFile(data + "/" + f.Name())
-		if err != nil {
-			return []Template{}, err
-		}
-
-		var t Template
-		if err := json.Unmarshal(file, &t); err != nil {
-			return []Template{}, err
-		}
-
-		templates = append(templates, t)
-	}
-
-	return templates, nil
-}
-
-func AddTemplate(t Template) error {
-	c := *config.Get()
-	data := utils.Normalize(c.System.DataDirectory + "/templates")
-
-	b, err := json.MarshalIndent(t, "", "    ")
-	if err != nil {
-		return err
-	}
-
-	if err = os.WriteFile(data+"/"+t.Uuid+".json", b, 0644); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func GetTemplate(id int) (Template, error) {
-	templates, _ := GetTemplates()
-	for _, t := range templates {
-		if t.Id == id {
-			return t, nil
-		}
-	}
-
-	return Template{}, errors.New("template not found")
-}
-
 func NewTestTemplate() Template {
 	return Template{
 		Id:          1,
@@ -115,13 +80,18 @@ func NewTestTemplate() Template {
 			StartConfig: "{\"started\": \"is now running!\"}",
 			ConfigFiles: []ConfigFile{
 				{
-					Path: "server.properties",
+					Path:   "server.properties",
+					Parser: "properties",
 					Content: `
 #Minecraft server properties
 #Thu Jan 01 00:00:00 CET 1970
 server-ip=0.0.0.0
 server-port={$PORT}
 `,
+					Replace: []parser.Replacement{
+						{Match: "server-ip", ReplaceWith: "0.0.0.0"},
+						{Match: "server-port", ReplaceWith: "{{server.build.default.port}}"},
+					},
 				},
 			},
 		},
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -28,7 +29,7 @@ func Normalize(path string) string {
 	}
 
 	d, _ := os.Getwd()
-	if !regexp.MustCompile(`^[A-Z]:`).MatchString(newPath) {
+	if !regexp.MustCompile(`^[A-Z]:`).MatchString(newPath) && !filepath.IsAbs(newPath) {
 		if !strings.HasPrefix(newPath, "/") {
 			d += "/"
 		}
@@ -36,7 +37,7 @@ func Normalize(path string) string {
 	}
 
 	newPath = strings.TrimSuffix(newPath, "/")
-	newPath = strings.ReplaceAll(newPath, "/", "\\")
+	newPath = filepath.FromSlash(newPath)
 	newPath = strings.Replace(newPath, "~", homeDir, 1)
 	return newPath
 }
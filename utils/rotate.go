@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions configures when a RotatingWriter starts a new file and how
+// long rotated files are kept. Zero values disable the respective limit.
+type RotateOptions struct {
+	MaxSize   int64         // bytes after which the file is rotated
+	MaxAge    time.Duration // age after which the file is rotated
+	Compress  bool          // gzip rotated files
+	MaxFiles  int           // rotated files to keep
+	Retention time.Duration // how long rotated files are kept
+}
+
+// RotatingWriter appends to <dir>/<name>.log, moving it aside to
+// <name>-<timestamp>.log when it grows too large or too old.
+type RotatingWriter struct {
+	mu      sync.Mutex
+	dir     string
+	name    string
+	options RotateOptions
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func NewRotatingWriter(dir string, name string, options RotateOptions) (*RotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &RotatingWriter{dir: dir, name: name, options: options}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *RotatingWriter) path() string {
+	return filepath.Join(w.dir, w.name+".log")
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.path(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	w.openedAt = info.ModTime()
+	if w.size == 0 {
+		w.openedAt = time.Now()
+	}
+
+	return nil
+}
+
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if w.size > 0 && w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) shouldRotate(next int64) bool {
+	if w.options.MaxSize > 0 && w.size+next > w.options.MaxSize {
+		return true
+	}
+
+	return w.options.MaxAge > 0 && time.Since(w.openedAt) > w.options.MaxAge
+}
+
+// Rotate moves the current file aside and starts a new one.
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+
+	return w.rotate()
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	rotated := filepath.Join(w.dir, w.name+"-"+time.Now().Format("20060102-150405.000")+".log")
+	if err := os.Rename(w.path(), rotated); err != nil {
+		if oerr := w.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	go func() {
+		if w.options.Compress {
+			_ = compressFile(rotated)
+		}
+		w.prune()
+	}()
+
+	return nil
+}
+
+// prune removes the rotated files that are past the retention or the maximum
+// amount of files.
+func (w *RotatingWriter) prune() {
+	files, err := RotatedFiles(w.dir, w.name)
+	if err != nil {
+		return
+	}
+
+	for i, f := range files {
+		expired := w.options.Retention > 0 && time.Since(f.ModTime()) > w.options.Retention
+		if expired || (w.options.MaxFiles > 0 && i >= w.options.MaxFiles) {
+			_ = os.Remove(filepath.Join(w.dir, f.Name()))
+		}
+	}
+}
+
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// RotatedFiles returns the files rotated out of <dir>/<name>.log, the most
+// recent first.
+func RotatedFiles(dir string, name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.FileInfo
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || !strings.HasPrefix(n, name+"-") || strings.HasSuffix(n, ".tmp") {
+			continue
+		}
+
+		if !strings.HasSuffix(n, ".log") && !strings.HasSuffix(n, ".log.gz") {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+
+	// the timestamp in the names sorts the same way as the time.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() > files[j].Name()
+	})
+
+	return files, nil
+}
+
+// compressFile replaces a file with a gzip compressed copy of it.
+func compressFile(p string) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(p + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if err == nil {
+		err = gw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(p+".gz.tmp", p+".gz")
+	}
+
+	if err != nil {
+		_ = os.Remove(p + ".gz.tmp")
+		return err
+	}
+
+	_ = os.Chtimes(p+".gz", info.ModTime(), info.ModTime())
+	return os.Remove(p)
+}
@@ -0,0 +1,35 @@
+package utils
+
+import "errors"
+
+var ErrWatchUnsupported = errors.New("watching directories is not supported on this platform")
+
+type WatchOp int
+
+const (
+	WatchCreate WatchOp = iota
+	WatchModify
+	WatchDelete
+	WatchMovedFrom
+	WatchMovedTo
+	WatchGone
+
+	// WatchOverflow means changes were lost, and the directory has to be
+	// read again to know its entries.
+	WatchOverflow
+)
+
+// WatchEvent is a single change reported by the platform watcher for an entry
+// of the watched directory.
+type WatchEvent struct {
+	Op     WatchOp
+	Name   string
+	Cookie uint32
+}
+
+// DirWatcher reports the changes made to the entries of a directory.
+type DirWatcher interface {
+	// Read blocks and calls fn for every change until the watcher is closed.
+	Read(fn func(WatchEvent)) error
+	Close() error
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+type inotifyBackend struct {
+	file *os.File
+	once sync.Once
+}
+
+// WatchDir starts watching the entries of a directory.
+func WatchDir(dir string) (DirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := uint32(syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+		syscall.IN_ONLYDIR)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+
+	// the descriptor is non-blocking, so the file is registered with the
+	// runtime poller and a pending read returns as soon as it is closed.
+	return &inotifyBackend{file: os.NewFile(uintptr(fd), "inotify")}, nil
+}
+
+func (b *inotifyBackend) Read(fn func(WatchEvent)) error {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := b.file.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(ev.Len)], "\x00"))
+			offset = nameStart + int(ev.Len)
+
+			change := WatchEvent{Name: name, Cookie: ev.Cookie}
+			switch {
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				change.Op = WatchOverflow
+			case ev.Mask&syscall.IN_CREATE != 0:
+				change.Op = WatchCreate
+			case ev.Mask&(syscall.IN_MODIFY|syscall.IN_ATTRIB) != 0:
+				change.Op = WatchModify
+			case ev.Mask&syscall.IN_DELETE != 0:
+				change.Op = WatchDelete
+			case ev.Mask&syscall.IN_MOVED_FROM != 0:
+				change.Op = WatchMovedFrom
+			case ev.Mask&syscall.IN_MOVED_TO != 0:
+				change.Op = WatchMovedTo
+			case ev.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+				change.Op = WatchGone
+			default:
+				continue
+			}
+
+			fn(change)
+		}
+	}
+}
+
+func (b *inotifyBackend) Close() error {
+	var err error
+	b.once.Do(func() {
+		err = b.file.Close()
+	})
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package utils
+
+// WatchDir starts watching the entries of a directory.
+func WatchDir(_ string) (DirWatcher, error) {
+	return nil, ErrWatchUnsupported
+}